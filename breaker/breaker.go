@@ -0,0 +1,319 @@
+package breaker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// breaker states
+const (
+	StateClosed   = "closed"    // the consumers fetch messages
+	StateOpen     = "open"      // the consumers are paused
+	StateHalfOpen = "half_open" // the consumers fetch messages until the first success or block
+)
+
+// States are all the breaker states.
+var States = []string{StateClosed, StateOpen, StateHalfOpen}
+
+// Breaker pauses the kafka consumers while elasticsearch can not accept writes: the cluster
+// is red or the documents are refused by a cluster block, such as the read_only_allow_delete
+// block of the flood stage disk watermark. The health is probed while it is open. Opened by a
+// block, it is closed once the cluster state confirms the write blocks of the blocked indices
+// are gone. Opened by a red cluster, it is half open once the cluster is not red anymore, the
+// consumers resume and it is closed by the first indexed document or a probe ProbeInterval
+// later. The blocked documents wait until it is closed, so that they are not all sent again
+// by each probe.
+type Breaker struct {
+	ctx context.Context
+	cfg Config
+	es  *elasticsearch.Client
+
+	resumed  atomic.Value // chan struct{} closed when the consumers can fetch
+	closed   atomic.Value // chan struct{} closed when the breaker is closed
+	halfOpen atomic.Bool
+
+	mux         sync.Mutex
+	state       string
+	reason      string
+	since       time.Time
+	blocked     map[string]struct{} // indices refusing writes since the opening, "" for unknown ones
+	transitions map[string]uint64
+	opened      time.Duration // total time spent open, without the current period
+}
+
+type Config struct {
+	Interval      time.Duration // _cluster/health 的查询间隔 Default: 10s
+	ProbeInterval time.Duration // 熔断后查询 _cluster/health 及 _cluster/state 写阻塞的间隔 Default: 5s
+	Timeout       time.Duration // _cluster/health 及 _cluster/state 的超时时间 Default: 5s
+}
+
+type Stats struct {
+	State       string
+	Reason      string            // reason of the last opening
+	Transitions map[string]uint64 // number of transitions by target state
+	Opened      time.Duration     // total time spent open
+}
+
+func New(ctx context.Context, es *elasticsearch.Client, cfg Config) *Breaker {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.ProbeInterval <= 0 {
+		cfg.ProbeInterval = 5 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	b := &Breaker{
+		ctx:         ctx,
+		cfg:         cfg,
+		es:          es,
+		state:       StateClosed,
+		since:       time.Now(),
+		blocked:     make(map[string]struct{}),
+		transitions: make(map[string]uint64),
+	}
+	closed := make(chan struct{})
+	close(closed)
+	b.resumed.Store(closed)
+	b.closed.Store(closed)
+	go b.monitor()
+	return b
+}
+
+// Wait blocks while the breaker is open, a nil breaker never blocks.
+func (b *Breaker) Wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	return wait(ctx, b.resumed.Load().(chan struct{}))
+}
+
+// WaitClosed blocks until the breaker is closed.
+func (b *Breaker) WaitClosed(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	return wait(ctx, b.closed.Load().(chan struct{}))
+}
+
+func wait(ctx context.Context, ch chan struct{}) error {
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Trip opens the breaker because a block of index refused a write, index is empty when the
+// whole bulk request was refused. It stays open until the block is gone.
+func (b *Breaker) Trip(index, reason string) {
+	if b == nil {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.blocked[index] = struct{}{}
+	if b.state != StateOpen {
+		b.transition(StateOpen, reason)
+	}
+}
+
+// Success closes the half open breaker once a document was indexed.
+func (b *Breaker) Success() {
+	if b == nil || !b.halfOpen.Load() {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.state == StateHalfOpen {
+		b.transition(StateClosed, "document indexed")
+	}
+}
+
+// transition must be called with the lock held.
+func (b *Breaker) transition(state, reason string) {
+	log.Printf("breaker %s -> %s: %s", b.state, state, reason)
+	now := time.Now()
+	if b.state == StateOpen {
+		b.opened += now.Sub(b.since)
+	}
+	switch state {
+	case StateOpen:
+		if b.state == StateClosed {
+			b.closed.Store(make(chan struct{}))
+		}
+		b.resumed.Store(make(chan struct{}))
+		b.reason = reason
+	case StateHalfOpen:
+		close(b.resumed.Load().(chan struct{}))
+	case StateClosed:
+		if b.state == StateOpen {
+			// straight from open once the write blocks are removed
+			close(b.resumed.Load().(chan struct{}))
+		}
+		close(b.closed.Load().(chan struct{}))
+		b.blocked = make(map[string]struct{})
+	}
+	b.halfOpen.Store(state == StateHalfOpen)
+	b.state, b.since = state, now
+	b.transitions[state]++
+}
+
+func (b *Breaker) Stats() Stats {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	stats := Stats{
+		State:       b.state,
+		Reason:      b.reason,
+		Transitions: make(map[string]uint64, len(b.transitions)),
+		Opened:      b.opened,
+	}
+	for state, n := range b.transitions {
+		stats.Transitions[state] = n
+	}
+	if b.state == StateOpen {
+		stats.Opened += time.Since(b.since)
+	}
+	return stats
+}
+
+// monitor polls the cluster health, every Interval while closed and ProbeInterval otherwise,
+// and the write blocks while it is opened by a block.
+func (b *Breaker) monitor() {
+	timer := time.NewTimer(b.cfg.Interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			status, err := b.health()
+			b.mux.Lock()
+			blocked := make([]string, 0, len(b.blocked))
+			for index := range b.blocked {
+				blocked = append(blocked, index)
+			}
+			probeBlocks := err == nil && status != "red" && b.state == StateOpen && len(blocked) > 0
+			b.mux.Unlock()
+			var blocks []string
+			var blocksErr error
+			if probeBlocks {
+				blocks, blocksErr = b.writeBlocks(blocked)
+			}
+			b.mux.Lock()
+			switch {
+			case err != nil:
+				// an unreachable cluster fails the bulk requests, which are retried or spooled
+				log.Printf("breaker cluster health: %s", err)
+			case status == "red" && b.state != StateOpen:
+				b.transition(StateOpen, "cluster health is red")
+			case status != "red" && b.state == StateOpen && len(b.blocked) == 0:
+				b.transition(StateHalfOpen, "cluster health is "+status)
+			case probeBlocks && blocksErr != nil:
+				// the block may still be there
+				log.Printf("breaker cluster blocks: %s", blocksErr)
+			case probeBlocks && len(blocks) == 0 && b.state == StateOpen && len(b.blocked) == len(blocked):
+				b.transition(StateClosed, "write blocks removed")
+			case probeBlocks && len(blocks) > 0:
+				log.Printf("breaker open, write blocks on %v", blocks)
+			case status != "red" && b.state == StateHalfOpen && time.Since(b.since) >= b.cfg.ProbeInterval:
+				b.transition(StateClosed, "cluster health is "+status+" during the probe")
+			}
+			interval := b.cfg.Interval
+			if b.state != StateClosed {
+				interval = b.cfg.ProbeInterval
+			}
+			b.mux.Unlock()
+			timer.Reset(interval)
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
+// writeBlocks returns the indices with a write block, "cluster" for a global one. An empty
+// index stands for an unknown one, any index with a write block then counts.
+func (b *Breaker) writeBlocks(indices []string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(b.ctx, b.cfg.Timeout)
+	defer cancel()
+	res, err := esapi.ClusterStateRequest{Metric: []string{"blocks"}}.Do(ctx, b.es)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("%s", res.Status())
+	}
+	var state struct {
+		Blocks struct {
+			Global  map[string]block            `json:"global"`
+			Indices map[string]map[string]block `json:"indices"`
+		} `json:"blocks"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&state); err != nil {
+		return nil, err
+	}
+	blocks := make([]string, 0)
+	if writeBlock(state.Blocks.Global) {
+		blocks = append(blocks, "cluster")
+	}
+	for _, index := range indices {
+		if index != "" {
+			if writeBlock(state.Blocks.Indices[index]) {
+				blocks = append(blocks, index)
+			}
+			continue
+		}
+		for name, indexBlocks := range state.Blocks.Indices {
+			if writeBlock(indexBlocks) {
+				blocks = append(blocks, name)
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// block is a cluster block of the cluster state, such as {"description": "index read-only /
+// allow delete (api)", "levels": ["write", "metadata_write"]} for FORBIDDEN/12.
+type block struct {
+	Description string   `json:"description"`
+	Levels      []string `json:"levels"`
+}
+
+func writeBlock(blocks map[string]block) bool {
+	for _, block := range blocks {
+		for _, level := range block.Levels {
+			if level == "write" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (b *Breaker) health() (string, error) {
+	ctx, cancel := context.WithTimeout(b.ctx, b.cfg.Timeout)
+	defer cancel()
+	res, err := esapi.ClusterHealthRequest{}.Do(ctx, b.es)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return "", fmt.Errorf("%s", res.Status())
+	}
+	var health struct {
+		Status string `json:"status"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&health); err != nil {
+		return "", err
+	}
+	return health.Status, nil
+}
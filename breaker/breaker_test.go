@@ -0,0 +1,133 @@
+package breaker
+
+import (
+	"context"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cluster answers the health and the blocks of the cluster state like elasticsearch.
+type cluster struct {
+	mux    sync.Mutex
+	status string
+	blocks string // indices blocks of the cluster state
+}
+
+func (c *cluster) set(status, blocks string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.status, c.blocks = status, blocks
+}
+
+func (c *cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/_cluster/health":
+		fmt.Fprintf(w, `{"status":%q}`, c.status)
+	case "/_cluster/state/blocks":
+		fmt.Fprintf(w, `{"blocks":{"indices":{%s}}}`, c.blocks)
+	default:
+		fmt.Fprint(w, `{"version":{"number":"7.17.10"}}`)
+	}
+}
+
+func newBreaker(t *testing.T, c *cluster) *Breaker {
+	t.Helper()
+	server := httptest.NewServer(c)
+	t.Cleanup(server.Close)
+	es, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return New(ctx, es, Config{Interval: 10 * time.Millisecond, ProbeInterval: 10 * time.Millisecond, Timeout: time.Second})
+}
+
+// waitState waits for the breaker to reach state.
+func waitState(t *testing.T, b *Breaker, state string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for b.Stats().State != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("state = %s, want %s", b.Stats().State, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func paused(b *Breaker) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	return b.Wait(ctx) != nil
+}
+
+func TestBreakerBlockRemoved(t *testing.T) {
+	c := &cluster{status: "green", blocks: `"logs":{"12":{"description":"index read-only / allow delete (api)","levels":["write","metadata_write"]}}`}
+	b := newBreaker(t, c)
+	b.Trip("logs", "cluster_block_exception")
+	if !paused(b) {
+		t.Fatal("consumers not paused by the block")
+	}
+	// a green cluster does not close the breaker while the index is blocked
+	time.Sleep(50 * time.Millisecond)
+	if state := b.Stats().State; state != StateOpen {
+		t.Fatalf("state = %s with the block, want %s", state, StateOpen)
+	}
+	c.set("green", `"other":{"8":{"description":"index write (api)","levels":["write"]}}`)
+	waitState(t, b, StateClosed)
+	if paused(b) {
+		t.Error("consumers still paused once the block is removed")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := b.WaitClosed(ctx); err != nil {
+		t.Errorf("WaitClosed: %s", err)
+	}
+}
+
+func TestBreakerRed(t *testing.T) {
+	c := &cluster{status: "red"}
+	b := newBreaker(t, c)
+	waitState(t, b, StateOpen)
+	if !paused(b) {
+		t.Fatal("consumers not paused while red")
+	}
+	// slower probes, so that the half open state is observed
+	b.mux.Lock()
+	b.cfg.ProbeInterval = 200 * time.Millisecond
+	b.mux.Unlock()
+	c.set("yellow", "")
+	waitState(t, b, StateHalfOpen)
+	if paused(b) {
+		t.Error("consumers paused while half open")
+	}
+	b.Success()
+	if state := b.Stats().State; state != StateClosed {
+		t.Fatalf("state = %s after an indexed document, want %s", state, StateClosed)
+	}
+	stats := b.Stats()
+	if stats.Transitions[StateOpen] != 1 || stats.Transitions[StateHalfOpen] != 1 || stats.Transitions[StateClosed] != 1 {
+		t.Errorf("transitions = %v", stats.Transitions)
+	}
+}
+
+func TestBreakerHalfOpenProbe(t *testing.T) {
+	c := &cluster{status: "red"}
+	b := newBreaker(t, c)
+	waitState(t, b, StateOpen)
+	c.set("green", "")
+	// closed by the probe ProbeInterval after the half open transition without document
+	waitState(t, b, StateClosed)
+	if paused(b) {
+		t.Error("consumers paused once closed")
+	}
+}
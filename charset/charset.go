@@ -0,0 +1,372 @@
+package charset
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/ydgo/k2es/deadletter"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// invalid utf-8 policies
+const (
+	InvalidReplace    = "replace"     // invalid sequences are replaced by U+FFFD
+	InvalidDrop       = "drop"        // the message is acknowledged without being indexed
+	InvalidDeadLetter = "dead_letter" // the message is sent to the dead letter topic
+)
+
+// ErrorType is the dead letter error type of the messages with invalid utf-8.
+const ErrorType = "k2es_invalid_utf8_exception"
+
+var encodings = map[string]encoding.Encoding{
+	"gbk":        simplifiedchinese.GBK,
+	"gb18030":    simplifiedchinese.GB18030,
+	"big5":       traditionalchinese.Big5,
+	"latin1":     charmap.ISO8859_1,
+	"iso-8859-1": charmap.ISO8859_1,
+}
+
+// replacement is the utf-8 encoding of U+FFFD, written by the decoders in place of invalid input
+var replacement = []byte(string(utf8.RuneError))
+
+type Config struct {
+	Charset    string             // gbk, gb18030, big5, latin1 Default: utf-8
+	Fields     []string           // json fields in the charset, nested fields separated by ., empty for the whole message
+	Invalid    string             // replace, drop, dead_letter Default: replace
+	DeadLetter *deadletter.Writer // required by dead_letter
+}
+
+// Converter converts messages to utf-8 and applies the invalid utf-8 policy.
+type Converter struct {
+	name     string
+	cfg      Config
+	encoding encoding.Encoding // nil for utf-8
+	fields   [][]string
+
+	multibyte bool // gbk, gb18030 and big5
+
+	converted    atomic.Uint64
+	replaced     atomic.Uint64
+	dropped      atomic.Uint64
+	deadLettered atomic.Uint64
+}
+
+// Stats are the message counters of a converter.
+type Stats struct {
+	Converter    string
+	Charset      string
+	Converted    uint64 // messages converted to utf-8
+	Replaced     uint64 // messages with invalid sequences replaced
+	Dropped      uint64
+	DeadLettered uint64
+}
+
+// New creates a converter, name identifies it in the logs and stats.
+func New(name string, cfg Config) (*Converter, error) {
+	c := &Converter{name: name, cfg: cfg}
+	switch charset := strings.ToLower(cfg.Charset); charset {
+	case "", "utf-8", "utf8":
+		c.cfg.Charset = "utf-8"
+	default:
+		enc, ok := encodings[charset]
+		if !ok {
+			return nil, fmt.Errorf("unknown charset %q", cfg.Charset)
+		}
+		c.encoding = enc
+		c.multibyte = enc != charmap.ISO8859_1
+	}
+	switch cfg.Invalid {
+	case "":
+		c.cfg.Invalid = InvalidReplace
+	case InvalidReplace, InvalidDrop:
+	case InvalidDeadLetter:
+		if cfg.DeadLetter == nil {
+			return nil, fmt.Errorf("the dead_letter policy requires a dead letter topic")
+		}
+	default:
+		return nil, fmt.Errorf("unknown invalid utf-8 policy %q", cfg.Invalid)
+	}
+	for _, field := range cfg.Fields {
+		c.fields = append(c.fields, strings.Split(field, "."))
+	}
+	return c, nil
+}
+
+func (c *Converter) Name() string {
+	return c.name
+}
+
+func (c *Converter) Stats() Stats {
+	return Stats{
+		Converter:    c.name,
+		Charset:      c.cfg.Charset,
+		Converted:    c.converted.Load(),
+		Replaced:     c.replaced.Load(),
+		Dropped:      c.dropped.Load(),
+		DeadLettered: c.deadLettered.Load(),
+	}
+}
+
+// Convert returns value in utf-8, invalid reports whether value had invalid sequences which
+// were replaced by U+FFFD.
+func (c *Converter) Convert(value []byte) (converted []byte, invalid bool, err error) {
+	if c.encoding == nil {
+		if utf8.Valid(value) {
+			return value, false, nil
+		}
+		return bytes.ToValidUTF8(value, replacement), true, nil
+	}
+	if len(c.fields) == 0 {
+		converted, invalid, err = c.decode(value)
+	} else {
+		converted, invalid, err = c.convertFields(value)
+	}
+	if err == nil {
+		c.converted.Add(1)
+	}
+	return converted, invalid, err
+}
+
+// decode converts text in the charset, a charset can not encode U+FFFD but gb18030 so the
+// replacement characters are the invalid input.
+func (c *Converter) decode(text []byte) ([]byte, bool, error) {
+	converted, err := c.encoding.NewDecoder().Bytes(text)
+	if err != nil {
+		return nil, false, err
+	}
+	return converted, bytes.Count(converted, replacement) > bytes.Count(text, replacement), nil
+}
+
+// convertFields converts the fields of a json document in place, the other fields may be
+// utf-8. The raw values are converted with their quotes and escapes, which are ascii.
+func (c *Converter) convertFields(value []byte) ([]byte, bool, error) {
+	invalid := false
+	for _, path := range c.fields {
+		start, end, ok, err := c.find(value, path)
+		if err != nil {
+			return nil, false, fmt.Errorf("decode document: %w", err)
+		}
+		if !ok {
+			continue
+		}
+		converted, inv, err := c.decode(value[start:end])
+		if err != nil {
+			return nil, false, err
+		}
+		body := make([]byte, 0, len(value)-(end-start)+len(converted))
+		body = append(append(append(body, value[:start]...), converted...), value[end:]...)
+		value, invalid = body, invalid || inv
+	}
+	return value, invalid, nil
+}
+
+// find returns the bounds of the raw value of the field at path, ok is false when the field
+// does not exist. The document is scanned in the charset rather than parsed as json, as the
+// trail byte of a gbk or big5 character may be a backslash.
+func (c *Converter) find(doc []byte, path []string) (start, end int, ok bool, err error) {
+	s := &scanner{data: doc, multibyte: c.multibyte}
+	s.space()
+	for _, key := range path {
+		if s.peek() != '{' {
+			// not an object, the field does not exist
+			return 0, 0, false, nil
+		}
+		if ok, err = s.member(key); err != nil || !ok {
+			return 0, 0, false, err
+		}
+	}
+	start = s.pos
+	if err = s.value(); err != nil {
+		return 0, 0, false, err
+	}
+	return start, s.pos, true, nil
+}
+
+// scanner walks a json document whose strings are in a charset.
+type scanner struct {
+	data      []byte
+	pos       int
+	multibyte bool // a byte from 0x81 is the lead byte of a character
+}
+
+func (s *scanner) peek() byte {
+	if s.pos < len(s.data) {
+		return s.data[s.pos]
+	}
+	return 0
+}
+
+func (s *scanner) space() {
+	for s.pos < len(s.data) && strings.IndexByte(" \t\r\n", s.data[s.pos]) >= 0 {
+		s.pos++
+	}
+}
+
+func (s *scanner) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("offset %d: %s", s.pos, fmt.Sprintf(format, args...))
+}
+
+// member moves to the value of key in the object at pos, ok is false when the object has no key.
+func (s *scanner) member(key string) (bool, error) {
+	s.pos++
+	s.space()
+	if s.peek() == '}' {
+		return false, nil
+	}
+	for {
+		start := s.pos
+		if err := s.string(); err != nil {
+			return false, err
+		}
+		name := s.data[start:s.pos]
+		s.space()
+		if s.peek() != ':' {
+			return false, s.errorf("expected : after object key")
+		}
+		s.pos++
+		s.space()
+		if equalKey(name, key) {
+			return true, nil
+		}
+		if err := s.value(); err != nil {
+			return false, err
+		}
+		s.space()
+		switch s.peek() {
+		case ',':
+			s.pos++
+			s.space()
+		case '}':
+			return false, nil
+		default:
+			return false, s.errorf("expected , or } after object value")
+		}
+	}
+}
+
+// value moves past the value at pos.
+func (s *scanner) value() error {
+	switch s.peek() {
+	case '"':
+		return s.string()
+	case '{', '[':
+		depth := 0
+		for s.pos < len(s.data) {
+			switch s.data[s.pos] {
+			case '"':
+				if err := s.string(); err != nil {
+					return err
+				}
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				if depth--; depth == 0 {
+					s.pos++
+					return nil
+				}
+			}
+			s.pos++
+		}
+		return s.errorf("unexpected end of document")
+	}
+	// number, true, false or null
+	start := s.pos
+	for s.pos < len(s.data) && strings.IndexByte(",}] \t\r\n", s.data[s.pos]) < 0 {
+		s.pos++
+	}
+	if s.pos == start {
+		return s.errorf("expected value")
+	}
+	return nil
+}
+
+// string moves past the string at pos, the byte after a lead byte is skipped as it may be
+// a quote or a backslash. The 4 bytes characters of gb18030 are 2 pairs of a lead byte and
+// a digit.
+func (s *scanner) string() error {
+	if s.peek() != '"' {
+		return s.errorf("expected string")
+	}
+	for s.pos++; s.pos < len(s.data); s.pos++ {
+		switch b := s.data[s.pos]; {
+		case b == '"':
+			s.pos++
+			return nil
+		case b == '\\', b >= 0x81 && s.multibyte:
+			s.pos++
+		}
+	}
+	return s.errorf("unterminated string")
+}
+
+// equalKey reports whether the quoted key name is key.
+func equalKey(name []byte, key string) bool {
+	if bytes.IndexByte(name, '\\') < 0 {
+		return string(name[1:len(name)-1]) == key
+	}
+	var unquoted string
+	return json.Unmarshal(name, &unquoted) == nil && unquoted == key
+}
+
+// Handler converts the messages with the converter of their topic before handing them to next.
+type Handler struct {
+	converters func(topic string) *Converter
+	next       func(ctx context.Context, msg kafka.Message, ack func(error)) error
+	logged     atomic.Int64 // unix time of the last logged failure
+}
+
+// NewHandler creates a handler, converters returns nil for the topics without charset policy.
+func NewHandler(converters func(topic string) *Converter, next func(ctx context.Context, msg kafka.Message, ack func(error)) error) *Handler {
+	return &Handler{converters: converters, next: next}
+}
+
+func (h *Handler) Handle(ctx context.Context, msg kafka.Message, ack func(error)) error {
+	c := h.converters(msg.Topic)
+	if c == nil {
+		return h.next(ctx, msg, ack)
+	}
+	value, invalid, err := c.Convert(msg.Value)
+	if err == nil && !invalid {
+		msg.Value = value
+		return h.next(ctx, msg, ack)
+	}
+	if err != nil {
+		value = bytes.ToValidUTF8(msg.Value, replacement)
+	}
+	// at most one log per second, a whole topic may be invalid
+	if now := time.Now().Unix(); h.logged.Swap(now) != now {
+		reason := "invalid utf-8"
+		if err != nil {
+			reason = err.Error()
+		}
+		log.Printf("convert %s %s/%d/%d from %s: %s, %s", c.name, msg.Topic, msg.Partition, msg.Offset, c.cfg.Charset, reason, c.cfg.Invalid)
+	}
+	switch c.cfg.Invalid {
+	case InvalidDrop:
+		c.dropped.Add(1)
+		ack(nil)
+		return nil
+	case InvalidDeadLetter:
+		c.deadLettered.Add(1)
+		reason := "invalid " + c.cfg.Charset
+		if err != nil {
+			reason = err.Error()
+		}
+		c.cfg.DeadLetter.Send(ctx, msg, deadletter.Rejection{ErrorType: ErrorType, ErrorReason: reason}, ack)
+		return nil
+	}
+	c.replaced.Add(1)
+	msg.Value = value
+	return h.next(ctx, msg, ack)
+}
@@ -0,0 +1,100 @@
+package charset
+
+import (
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"testing"
+)
+
+func TestConvertFields(t *testing.T) {
+	big5 := func(s string) string {
+		b, _ := traditionalchinese.Big5.NewEncoder().String(s)
+		return b
+	}
+	gbk := func(s string) string {
+		b, _ := simplifiedchinese.GBK.NewEncoder().String(s)
+		return b
+	}
+	tests := []struct {
+		name    string
+		charset string
+		fields  []string
+		value   string
+		want    string
+	}{
+		{
+			name:    "trail byte backslash before the closing quote",
+			charset: "big5",
+			fields:  []string{"msg"},
+			value:   `{"msg":"` + big5("成功") + `","app":"k2es数据源"}`,
+			want:    `{"msg":"成功","app":"k2es数据源"}`,
+		},
+		{
+			name:    "trail byte backslash in a skipped field",
+			charset: "big5",
+			fields:  []string{"msg"},
+			value:   `{"raw":"` + big5("功") + `", "msg": "` + big5("許功蓋") + `"}`,
+			want:    `{"raw":"` + big5("功") + `", "msg": "許功蓋"}`,
+		},
+		{
+			name:    "nested field",
+			charset: "gbk",
+			fields:  []string{"a.b"},
+			value:   `{"a":{"c":[1,{"d":"}"}],"b":"` + gbk("中文") + `"},"b":"` + gbk("中文") + `"}`,
+			want:    `{"a":{"c":[1,{"d":"}"}],"b":"中文"},"b":"` + gbk("中文") + `"}`,
+		},
+		{
+			name:    "escape in the value",
+			charset: "gbk",
+			fields:  []string{"msg"},
+			value:   `{"msg":"` + gbk("中文") + `\"x"}`,
+			want:    `{"msg":"中文\"x"}`,
+		},
+		{
+			name:    "escaped key",
+			charset: "gbk",
+			fields:  []string{"msg"},
+			value:   `{"m\u0073g":"` + gbk("中文") + `"}`,
+			want:    `{"m\u0073g":"中文"}`,
+		},
+		{
+			name:    "missing field",
+			charset: "gbk",
+			fields:  []string{"msg", "a.b"},
+			value:   `{"a":"b"}`,
+			want:    `{"a":"b"}`,
+		},
+		{
+			name:    "not an object",
+			charset: "gbk",
+			fields:  []string{"msg"},
+			value:   `["msg"]`,
+			want:    `["msg"]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New("test", Config{Charset: tt.charset, Fields: tt.fields})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, invalid, err := c.Convert([]byte(tt.value))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if invalid || string(got) != tt.want {
+				t.Errorf("Convert() = %s, %t, want %s", got, invalid, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertFieldsInvalidDocument(t *testing.T) {
+	c, err := New("test", Config{Charset: "big5", Fields: []string{"msg"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.Convert([]byte(`{"raw":"unterminated`)); err == nil {
+		t.Error("Convert() of an unterminated string succeeded")
+	}
+}
@@ -0,0 +1,125 @@
+package codec
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/linkedin/goavro/v2"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RegistryConfig is the config of a confluent schema registry.
+type RegistryConfig struct {
+	URL      string
+	Username string
+	Password string
+	Timeout  time.Duration // Default: 10s
+}
+
+// Registry fetches the avro schemas of a confluent schema registry by id, the schemas are
+// immutable so they are cached forever.
+type Registry struct {
+	cfg    RegistryConfig
+	client *http.Client
+	mux    sync.RWMutex
+	codecs map[uint32]*goavro.Codec
+}
+
+func NewRegistry(cfg RegistryConfig) *Registry {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	cfg.URL = strings.TrimRight(cfg.URL, "/")
+	return &Registry{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		codecs: make(map[uint32]*goavro.Codec),
+	}
+}
+
+// Codec returns the codec of the schema id, schemas with references are not supported.
+func (r *Registry) Codec(id uint32) (*goavro.Codec, error) {
+	r.mux.RLock()
+	codec, ok := r.codecs[id]
+	r.mux.RUnlock()
+	if ok {
+		return codec, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, r.cfg.URL+"/schemas/ids/"+strconv.FormatUint(uint64(id), 10), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if r.cfg.Username != "" {
+		req.SetBasicAuth(r.cfg.Username, r.cfg.Password)
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch schema %d: %w: %w", id, ErrUnavailable, err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fetch schema %d: %w: %w", id, ErrUnavailable, err)
+	}
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= http.StatusInternalServerError {
+		return nil, fmt.Errorf("fetch schema %d: %w: %s %s", id, ErrUnavailable, res.Status, body)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch schema %d: %s %s", id, res.Status, body)
+	}
+	var schema struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType"`
+	}
+	if err = json.Unmarshal(body, &schema); err != nil {
+		return nil, fmt.Errorf("decode schema %d: %w", id, err)
+	}
+	if schema.SchemaType != "" && schema.SchemaType != "AVRO" {
+		return nil, fmt.Errorf("schema %d is %s, not avro", id, schema.SchemaType)
+	}
+	// unions are encoded as their value instead of {"type": value}
+	codec, err = goavro.NewCodecForStandardJSONFull(schema.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("parse schema %d: %w", id, err)
+	}
+
+	r.mux.Lock()
+	r.codecs[id] = codec
+	r.mux.Unlock()
+	return codec, nil
+}
+
+// avroCodec decodes the confluent wire format: a zero magic byte, the big endian schema id
+// on 4 bytes, then the avro binary encoding of a record.
+type avroCodec struct {
+	registry *Registry
+}
+
+func (c *avroCodec) Decode(value []byte) ([]byte, error) {
+	if len(value) < 5 || value[0] != 0 {
+		return nil, fmt.Errorf("avro: not the confluent wire format")
+	}
+	codec, err := c.registry.Codec(binary.BigEndian.Uint32(value[1:5]))
+	if err != nil {
+		return nil, fmt.Errorf("avro: %w", err)
+	}
+	native, _, err := codec.NativeFromBinary(value[5:])
+	if err != nil {
+		return nil, fmt.Errorf("avro: %w", err)
+	}
+	if _, ok := native.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("avro: schema %s is not a record", codec.Schema())
+	}
+	body, err := codec.TextualFromNative(nil, native)
+	if err != nil {
+		return nil, fmt.Errorf("avro: %w", err)
+	}
+	return body, nil
+}
@@ -0,0 +1,199 @@
+package codec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/ydgo/k2es/deadletter"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// codec types
+const (
+	TypeJSON     = "json"
+	TypeText     = "text"
+	TypeLogfmt   = "logfmt"
+	TypeCSV      = "csv"
+	TypeAvro     = "avro"
+	TypeProtobuf = "protobuf"
+)
+
+// ErrorType is the dead letter error type of the messages failing to decode.
+const ErrorType = "k2es_decode_exception"
+
+// ErrUnavailable wraps the decode errors caused by an unavailable schema registry, the
+// message is not at fault and is decoded again.
+var ErrUnavailable = errors.New("schema registry unavailable")
+
+// maxBackoff is the longest wait between two decodings of a message while the schema
+// registry is unavailable
+const maxBackoff = 30 * time.Second
+
+// Codec decodes the value of a kafka message into a json document.
+type Codec interface {
+	Decode(value []byte) ([]byte, error)
+}
+
+// Config declares a codec, the fields used depend on the type.
+type Config struct {
+	Type string
+
+	Field string // text: field of the line Default: _raw
+
+	Columns   []string // csv: column names in order, an empty name skips the column
+	Separator string   // csv Default: ,
+
+	SchemaRegistry RegistryConfig // avro
+
+	DescriptorSet string // protobuf: file set generated by protoc --include_imports --descriptor_set_out
+	Message       string // protobuf: full name of the message
+
+	DeadLetter *deadletter.Writer // messages failing to decode are sent to it, dropped when nil
+}
+
+// Decoder is a named codec counting the messages it decoded.
+type Decoder struct {
+	name       string
+	typ        string
+	codec      Codec
+	deadLetter *deadletter.Writer
+
+	decoded      atomic.Uint64
+	failed       atomic.Uint64
+	deadLettered atomic.Uint64
+	unavailable  atomic.Uint64
+}
+
+// Stats are the message counters of a decoder.
+type Stats struct {
+	Decoder      string
+	Type         string
+	Decoded      uint64
+	Failed       uint64 // messages failing to decode, dead lettered or dropped
+	DeadLettered uint64
+	Unavailable  uint64 // decodings failed by an unavailable schema registry, retried
+}
+
+// New creates the decoder of a codec, name identifies it in the logs and stats.
+func New(name string, cfg Config) (*Decoder, error) {
+	var c Codec
+	switch cfg.Type {
+	case TypeJSON, "":
+		cfg.Type = TypeJSON
+		c = jsonCodec{}
+	case TypeText:
+		if cfg.Field == "" {
+			cfg.Field = "_raw"
+		}
+		c = &textCodec{field: cfg.Field}
+	case TypeLogfmt:
+		c = logfmtCodec{}
+	case TypeCSV:
+		csv, err := newCSVCodec(cfg.Columns, cfg.Separator)
+		if err != nil {
+			return nil, err
+		}
+		c = csv
+	case TypeAvro:
+		if cfg.SchemaRegistry.URL == "" {
+			return nil, fmt.Errorf("schema registry url is required")
+		}
+		c = &avroCodec{registry: NewRegistry(cfg.SchemaRegistry)}
+	case TypeProtobuf:
+		protobuf, err := newProtobufCodec(cfg.DescriptorSet, cfg.Message)
+		if err != nil {
+			return nil, err
+		}
+		c = protobuf
+	default:
+		return nil, fmt.Errorf("unknown codec type %q", cfg.Type)
+	}
+	return &Decoder{name: name, typ: cfg.Type, codec: c, deadLetter: cfg.DeadLetter}, nil
+}
+
+func (d *Decoder) Name() string {
+	return d.name
+}
+
+func (d *Decoder) Decode(value []byte) ([]byte, error) {
+	body, err := d.codec.Decode(value)
+	if errors.Is(err, ErrUnavailable) {
+		d.unavailable.Add(1)
+		return nil, err
+	}
+	if err != nil {
+		d.failed.Add(1)
+		return nil, err
+	}
+	d.decoded.Add(1)
+	return body, nil
+}
+
+func (d *Decoder) Stats() Stats {
+	return Stats{
+		Decoder:      d.name,
+		Type:         d.typ,
+		Decoded:      d.decoded.Load(),
+		Failed:       d.failed.Load(),
+		DeadLettered: d.deadLettered.Load(),
+		Unavailable:  d.unavailable.Load(),
+	}
+}
+
+// Handler decodes the messages with the decoder of their topic before handing them to next.
+type Handler struct {
+	decoders func(topic string) *Decoder
+	next     func(ctx context.Context, msg kafka.Message, ack func(error)) error
+	logged   atomic.Int64 // unix time of the last logged failure
+}
+
+// NewHandler creates a handler, decoders returns nil for the topics of json messages.
+func NewHandler(decoders func(topic string) *Decoder, next func(ctx context.Context, msg kafka.Message, ack func(error)) error) *Handler {
+	return &Handler{decoders: decoders, next: next}
+}
+
+// Handle decodes msg before handing it to next. A message failing to decode is sent to the
+// dead letter topic, or dropped without one: its value is not a json document and would fail
+// the whole bulk request. While the schema registry is unavailable the message is decoded
+// again with a backoff, which pauses the consumer.
+func (h *Handler) Handle(ctx context.Context, msg kafka.Message, ack func(error)) error {
+	decoder := h.decoders(msg.Topic)
+	if decoder == nil {
+		return h.next(ctx, msg, ack)
+	}
+	value, err := decoder.Decode(msg.Value)
+	for backoff := time.Second; errors.Is(err, ErrUnavailable); backoff *= 2 {
+		h.log(decoder, msg, err)
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		value, err = decoder.Decode(msg.Value)
+	}
+	if err != nil {
+		h.log(decoder, msg, err)
+		if decoder.deadLetter == nil {
+			ack(nil)
+			return nil
+		}
+		decoder.deadLettered.Add(1)
+		decoder.deadLetter.Send(ctx, msg, deadletter.Rejection{ErrorType: ErrorType, ErrorReason: err.Error()}, ack)
+		return nil
+	}
+	msg.Value = value
+	return h.next(ctx, msg, ack)
+}
+
+// log logs at most once per second, a whole topic may fail.
+func (h *Handler) log(decoder *Decoder, msg kafka.Message, err error) {
+	if now := time.Now().Unix(); h.logged.Swap(now) != now {
+		log.Printf("decode %s %s/%d/%d: %s", decoder.name, msg.Topic, msg.Partition, msg.Offset, err)
+	}
+}
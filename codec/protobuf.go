@@ -0,0 +1,60 @@
+package codec
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"os"
+)
+
+// protobufCodec decodes the messages of a type of a descriptor set.
+type protobufCodec struct {
+	descriptor protoreflect.MessageDescriptor
+	marshal    protojson.MarshalOptions
+}
+
+func newProtobufCodec(file string, message string) (*protobufCodec, error) {
+	if file == "" || message == "" {
+		return nil, fmt.Errorf("protobuf descriptor set and message are required")
+	}
+	body, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read descriptor set: %w", err)
+	}
+	set := new(descriptorpb.FileDescriptorSet)
+	if err = proto.Unmarshal(body, set); err != nil {
+		return nil, fmt.Errorf("decode descriptor set %s: %w", file, err)
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor set %s: %w", file, err)
+	}
+	descriptor, err := files.FindDescriptorByName(protoreflect.FullName(message))
+	if err != nil {
+		return nil, fmt.Errorf("find message %s: %w", message, err)
+	}
+	md, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a message", message)
+	}
+	return &protobufCodec{
+		descriptor: md,
+		marshal:    protojson.MarshalOptions{UseProtoNames: true},
+	}, nil
+}
+
+func (c *protobufCodec) Decode(value []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(c.descriptor)
+	if err := proto.Unmarshal(value, msg); err != nil {
+		return nil, fmt.Errorf("protobuf: %w", err)
+	}
+	body, err := c.marshal.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("protobuf: %w", err)
+	}
+	return body, nil
+}
@@ -0,0 +1,137 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf8"
+)
+
+// jsonCodec keeps json documents as they are.
+type jsonCodec struct{}
+
+func (jsonCodec) Decode(value []byte) ([]byte, error) {
+	return value, nil
+}
+
+// textCodec wraps a line as {"_raw": line}.
+type textCodec struct {
+	field string
+}
+
+func (c *textCodec) Decode(value []byte) ([]byte, error) {
+	key, _ := json.Marshal(c.field)
+	line, err := json.Marshal(string(bytes.TrimRight(value, "\r\n")))
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, 0, len(key)+len(line)+3)
+	body = append(body, '{')
+	body = append(body, key...)
+	body = append(body, ':')
+	body = append(body, line...)
+	return append(body, '}'), nil
+}
+
+// logfmtCodec decodes key=value pairs, such as level=info msg="request done" took=3ms,
+// a key without a value is true.
+type logfmtCodec struct{}
+
+func (logfmtCodec) Decode(value []byte) ([]byte, error) {
+	fields := make(map[string]interface{})
+	s := string(value)
+	for i := 0; i < len(s); {
+		if s[i] <= ' ' {
+			i++
+			continue
+		}
+		start := i
+		for i < len(s) && s[i] > ' ' && s[i] != '=' {
+			i++
+		}
+		key := s[start:i]
+		if key == "" {
+			return nil, fmt.Errorf("logfmt: empty key at %d", i)
+		}
+		if i >= len(s) || s[i] != '=' {
+			fields[key] = true
+			continue
+		}
+		i++
+		if i < len(s) && s[i] == '"' {
+			start = i
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("logfmt: unterminated quote of %s", key)
+			}
+			i++
+			quoted, err := strconv.Unquote(s[start:i])
+			if err != nil {
+				quoted = s[start+1 : i-1]
+			}
+			fields[key] = quoted
+			continue
+		}
+		start = i
+		for i < len(s) && s[i] > ' ' {
+			i++
+		}
+		fields[key] = s[start:i]
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("logfmt: no field")
+	}
+	return json.Marshal(fields)
+}
+
+// csvCodec decodes a record into its columns.
+type csvCodec struct {
+	columns   []string
+	separator rune
+}
+
+func newCSVCodec(columns []string, separator string) (*csvCodec, error) {
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("csv columns are required")
+	}
+	c := &csvCodec{columns: columns, separator: ','}
+	if separator != "" {
+		r, size := utf8.DecodeRuneInString(separator)
+		if size != len(separator) || r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+			return nil, fmt.Errorf("invalid csv separator %q", separator)
+		}
+		c.separator = r
+	}
+	return c, nil
+}
+
+func (c *csvCodec) Decode(value []byte) ([]byte, error) {
+	reader := csv.NewReader(bytes.NewReader(value))
+	reader.Comma = c.separator
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	record, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("csv: %w", err)
+	}
+	if _, err = reader.Read(); err != io.EOF {
+		return nil, fmt.Errorf("csv: more than one record")
+	}
+	if len(record) > len(c.columns) {
+		return nil, fmt.Errorf("csv: %d values for %d columns", len(record), len(c.columns))
+	}
+	fields := make(map[string]string, len(record))
+	for i, v := range record {
+		if name := c.columns[i]; name != "" && name != "_" {
+			fields[name] = v
+		}
+	}
+	return json.Marshal(fields)
+}
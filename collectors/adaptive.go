@@ -0,0 +1,63 @@
+package collectors
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ydgo/k2es/indexer"
+)
+
+type adaptiveCollector struct {
+	mgmt          *indexer.Mgmt
+	workers       *prometheus.Desc
+	flushBytes    *prometheus.Desc
+	inFlight      *prometheus.Desc
+	latency       *prometheus.Desc
+	took          *prometheus.Desc
+	rejectionRate *prometheus.Desc
+	failed        *prometheus.Desc
+}
+
+func NewAdaptiveCollector(mgmt *indexer.Mgmt) prometheus.Collector {
+	fqName := func(name string) string {
+		return "k2es_adaptive_" + name
+	}
+	labels := []string{"index", "pipeline"}
+	return &adaptiveCollector{
+		mgmt: mgmt,
+		workers: prometheus.NewDesc(fqName("workers"),
+			"The number of concurrent bulk requests decided for the index", labels, nil),
+		flushBytes: prometheus.NewDesc(fqName("flush_bytes"),
+			"The flush size of the bulk requests decided for the index", labels, nil),
+		inFlight: prometheus.NewDesc(fqName("in_flight_requests"),
+			"The number of bulk requests of the index waiting for elasticsearch", labels, nil),
+		latency: prometheus.NewDesc(fqName("latency_seconds"),
+			"The mean bulk request latency of the last interval", labels, nil),
+		took: prometheus.NewDesc(fqName("took_seconds"),
+			"The mean took of the bulk responses of the last interval", labels, nil),
+		rejectionRate: prometheus.NewDesc(fqName("rejection_rate"),
+			"The rate of the documents rejected with 429 of the last interval", labels, nil),
+		failed: prometheus.NewDesc(fqName("failed_requests"),
+			"The number of bulk requests failed as a whole of the last interval", labels, nil),
+	}
+}
+
+func (c *adaptiveCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.workers
+	ch <- c.flushBytes
+	ch <- c.inFlight
+	ch <- c.latency
+	ch <- c.took
+	ch <- c.rejectionRate
+	ch <- c.failed
+}
+
+func (c *adaptiveCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, stats := range c.mgmt.AdaptiveStats() {
+		ch <- prometheus.MustNewConstMetric(c.workers, prometheus.GaugeValue, float64(stats.Workers), stats.Index, stats.Pipeline)
+		ch <- prometheus.MustNewConstMetric(c.flushBytes, prometheus.GaugeValue, float64(stats.FlushBytes), stats.Index, stats.Pipeline)
+		ch <- prometheus.MustNewConstMetric(c.inFlight, prometheus.GaugeValue, float64(stats.InFlight), stats.Index, stats.Pipeline)
+		ch <- prometheus.MustNewConstMetric(c.latency, prometheus.GaugeValue, stats.Latency.Seconds(), stats.Index, stats.Pipeline)
+		ch <- prometheus.MustNewConstMetric(c.took, prometheus.GaugeValue, stats.Took.Seconds(), stats.Index, stats.Pipeline)
+		ch <- prometheus.MustNewConstMetric(c.rejectionRate, prometheus.GaugeValue, stats.RejectionRate, stats.Index, stats.Pipeline)
+		ch <- prometheus.MustNewConstMetric(c.failed, prometheus.GaugeValue, float64(stats.Failed), stats.Index, stats.Pipeline)
+	}
+}
@@ -0,0 +1,47 @@
+package collectors
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ydgo/k2es/breaker"
+)
+
+type breakerCollector struct {
+	breaker     *breaker.Breaker
+	state       *prometheus.Desc
+	transitions *prometheus.Desc
+	opened      *prometheus.Desc
+}
+
+func NewBreakerCollector(b *breaker.Breaker) prometheus.Collector {
+	fqName := func(name string) string {
+		return "k2es_breaker_" + name
+	}
+	return &breakerCollector{
+		breaker: b,
+		state: prometheus.NewDesc(fqName("state"),
+			"The state of the elasticsearch circuit breaker, 1 for the current state", []string{"state"}, nil),
+		transitions: prometheus.NewDesc(fqName("transitions_total"),
+			"The number of transitions of the circuit breaker to the state", []string{"state"}, nil),
+		opened: prometheus.NewDesc(fqName("open_seconds_total"),
+			"The time the consumers were paused by the circuit breaker", nil, nil),
+	}
+}
+
+func (c *breakerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.state
+	ch <- c.transitions
+	ch <- c.opened
+}
+
+func (c *breakerCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.breaker.Stats()
+	for _, state := range breaker.States {
+		value := 0.0
+		if state == stats.State {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.state, prometheus.GaugeValue, value, state)
+		ch <- prometheus.MustNewConstMetric(c.transitions, prometheus.CounterValue, float64(stats.Transitions[state]), state)
+	}
+	ch <- prometheus.MustNewConstMetric(c.opened, prometheus.CounterValue, stats.Opened.Seconds())
+}
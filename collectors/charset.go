@@ -0,0 +1,49 @@
+package collectors
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ydgo/k2es/charset"
+)
+
+type charsetCollector struct {
+	converters   []*charset.Converter
+	converted    *prometheus.Desc
+	replaced     *prometheus.Desc
+	dropped      *prometheus.Desc
+	deadLettered *prometheus.Desc
+}
+
+func NewCharsetCollector(converters []*charset.Converter) prometheus.Collector {
+	fqName := func(name string) string {
+		return "k2es_charset_" + name
+	}
+	labels := []string{"converter", "charset"}
+	return &charsetCollector{
+		converters: converters,
+		converted: prometheus.NewDesc(fqName("messages_converted_total"),
+			"The number of messages converted to utf-8", labels, nil),
+		replaced: prometheus.NewDesc(fqName("messages_replaced_total"),
+			"The number of messages with invalid utf-8 replaced by U+FFFD", labels, nil),
+		dropped: prometheus.NewDesc(fqName("messages_dropped_total"),
+			"The number of messages with invalid utf-8 dropped", labels, nil),
+		deadLettered: prometheus.NewDesc(fqName("messages_dead_lettered_total"),
+			"The number of messages with invalid utf-8 sent to the dead letter topic", labels, nil),
+	}
+}
+
+func (c *charsetCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.converted
+	ch <- c.replaced
+	ch <- c.dropped
+	ch <- c.deadLettered
+}
+
+func (c *charsetCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, converter := range c.converters {
+		stats := converter.Stats()
+		ch <- prometheus.MustNewConstMetric(c.converted, prometheus.CounterValue, float64(stats.Converted), stats.Converter, stats.Charset)
+		ch <- prometheus.MustNewConstMetric(c.replaced, prometheus.CounterValue, float64(stats.Replaced), stats.Converter, stats.Charset)
+		ch <- prometheus.MustNewConstMetric(c.dropped, prometheus.CounterValue, float64(stats.Dropped), stats.Converter, stats.Charset)
+		ch <- prometheus.MustNewConstMetric(c.deadLettered, prometheus.CounterValue, float64(stats.DeadLettered), stats.Converter, stats.Charset)
+	}
+}
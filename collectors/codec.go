@@ -0,0 +1,49 @@
+package collectors
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ydgo/k2es/codec"
+)
+
+type codecCollector struct {
+	decoders     []*codec.Decoder
+	decoded      *prometheus.Desc
+	failed       *prometheus.Desc
+	deadLettered *prometheus.Desc
+	unavailable  *prometheus.Desc
+}
+
+func NewCodecCollector(decoders []*codec.Decoder) prometheus.Collector {
+	fqName := func(name string) string {
+		return "k2es_codec_" + name
+	}
+	labels := []string{"decoder", "type"}
+	return &codecCollector{
+		decoders: decoders,
+		decoded: prometheus.NewDesc(fqName("messages_decoded_total"),
+			"The number of messages decoded into json documents", labels, nil),
+		failed: prometheus.NewDesc(fqName("messages_failed_total"),
+			"The number of messages failing to decode, dead lettered or dropped", labels, nil),
+		deadLettered: prometheus.NewDesc(fqName("messages_dead_lettered_total"),
+			"The number of messages failing to decode sent to the dead letter topic", labels, nil),
+		unavailable: prometheus.NewDesc(fqName("registry_unavailable_total"),
+			"The number of decodings failed by an unavailable schema registry, decoded again", labels, nil),
+	}
+}
+
+func (c *codecCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.decoded
+	ch <- c.failed
+	ch <- c.deadLettered
+	ch <- c.unavailable
+}
+
+func (c *codecCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, decoder := range c.decoders {
+		stats := decoder.Stats()
+		ch <- prometheus.MustNewConstMetric(c.decoded, prometheus.CounterValue, float64(stats.Decoded), stats.Decoder, stats.Type)
+		ch <- prometheus.MustNewConstMetric(c.failed, prometheus.CounterValue, float64(stats.Failed), stats.Decoder, stats.Type)
+		ch <- prometheus.MustNewConstMetric(c.deadLettered, prometheus.CounterValue, float64(stats.DeadLettered), stats.Decoder, stats.Type)
+		ch <- prometheus.MustNewConstMetric(c.unavailable, prometheus.CounterValue, float64(stats.Unavailable), stats.Decoder, stats.Type)
+	}
+}
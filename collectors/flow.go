@@ -0,0 +1,46 @@
+package collectors
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ydgo/k2es/flow"
+)
+
+type flowCollector struct {
+	budget   *flow.Budget
+	max      *prometheus.Desc
+	inFlight *prometheus.Desc
+	blocks   *prometheus.Desc
+	blocked  *prometheus.Desc
+}
+
+func NewFlowCollector(budget *flow.Budget) prometheus.Collector {
+	fqName := func(name string) string {
+		return "k2es_flow_" + name
+	}
+	return &flowCollector{
+		budget: budget,
+		max: prometheus.NewDesc(fqName("max_bytes"),
+			"The in-flight bytes budget shared by all consumers", nil, nil),
+		inFlight: prometheus.NewDesc(fqName("in_flight_bytes"),
+			"The bytes of the messages fetched and not yet acknowledged by elasticsearch", nil, nil),
+		blocks: prometheus.NewDesc(fqName("blocks_total"),
+			"The number of times a consumer waited for the budget", nil, nil),
+		blocked: prometheus.NewDesc(fqName("blocked_seconds_total"),
+			"The time consumers spent waiting for the budget", nil, nil),
+	}
+}
+
+func (c *flowCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.max
+	ch <- c.inFlight
+	ch <- c.blocks
+	ch <- c.blocked
+}
+
+func (c *flowCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.budget.Stats()
+	ch <- prometheus.MustNewConstMetric(c.max, prometheus.GaugeValue, float64(stats.MaxBytes))
+	ch <- prometheus.MustNewConstMetric(c.inFlight, prometheus.GaugeValue, float64(stats.InFlightBytes))
+	ch <- prometheus.MustNewConstMetric(c.blocks, prometheus.CounterValue, float64(stats.Blocks))
+	ch <- prometheus.MustNewConstMetric(c.blocked, prometheus.CounterValue, stats.Blocked.Seconds())
+}
@@ -0,0 +1,30 @@
+package collectors
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ydgo/k2es/indexer"
+)
+
+type latencyCollector struct {
+	latency *indexer.Latency
+	seconds *prometheus.Desc
+}
+
+func NewLatencyCollector(latency *indexer.Latency) prometheus.Collector {
+	return &latencyCollector{
+		latency: latency,
+		seconds: prometheus.NewDesc("k2es_end_to_end_latency_seconds",
+			"The latency from the kafka message timestamp (source kafka) or the event time of the document (source event) to the elasticsearch acknowledgement",
+			[]string{"topic", "source"}, nil),
+	}
+}
+
+func (c *latencyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.seconds
+}
+
+func (c *latencyCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, stats := range c.latency.Stats() {
+		ch <- prometheus.MustNewConstHistogram(c.seconds, stats.Count, stats.Sum, stats.Buckets, stats.Topic, stats.Source)
+	}
+}
@@ -0,0 +1,62 @@
+package collectors
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ydgo/k2es/processor"
+)
+
+type processorCollector struct {
+	chains   []*processor.Chain
+	in       *prometheus.Desc
+	out      *prometheus.Desc
+	dropped  *prometheus.Desc
+	errored  *prometheus.Desc
+	withheld *prometheus.Desc
+	matches  *prometheus.Desc
+}
+
+func NewProcessorCollector(chains []*processor.Chain) prometheus.Collector {
+	fqName := func(name string) string {
+		return "k2es_processor_" + name
+	}
+	labels := []string{"chain", "processor"}
+	return &processorCollector{
+		chains: chains,
+		in: prometheus.NewDesc(fqName("events_in_total"),
+			"The number of events received by the processor", labels, nil),
+		out: prometheus.NewDesc(fqName("events_out_total"),
+			"The number of events returned by the processor", labels, nil),
+		dropped: prometheus.NewDesc(fqName("events_dropped_total"),
+			"The number of events dropped by the processor", labels, nil),
+		errored: prometheus.NewDesc(fqName("events_errored_total"),
+			"The number of events the processor failed on", labels, nil),
+		withheld: prometheus.NewDesc(fqName("messages_withheld_total"),
+			"The number of messages not indexed because the redact processor could not run, sent to the dead letter topic when there is one", labels, nil),
+		matches: prometheus.NewDesc(fqName("matches_total"),
+			"The number of matches of a rule of the processor, such as the redacted values", append(labels, "rule"), nil),
+	}
+}
+
+func (c *processorCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.in
+	ch <- c.out
+	ch <- c.dropped
+	ch <- c.errored
+	ch <- c.withheld
+	ch <- c.matches
+}
+
+func (c *processorCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, chain := range c.chains {
+		for _, stats := range chain.Stats() {
+			ch <- prometheus.MustNewConstMetric(c.in, prometheus.CounterValue, float64(stats.In), stats.Chain, stats.Processor)
+			ch <- prometheus.MustNewConstMetric(c.out, prometheus.CounterValue, float64(stats.Out), stats.Chain, stats.Processor)
+			ch <- prometheus.MustNewConstMetric(c.dropped, prometheus.CounterValue, float64(stats.Dropped), stats.Chain, stats.Processor)
+			ch <- prometheus.MustNewConstMetric(c.errored, prometheus.CounterValue, float64(stats.Errored), stats.Chain, stats.Processor)
+			ch <- prometheus.MustNewConstMetric(c.withheld, prometheus.CounterValue, float64(stats.Withheld), stats.Chain, stats.Processor)
+		}
+		for _, count := range chain.Counts() {
+			ch <- prometheus.MustNewConstMetric(c.matches, prometheus.CounterValue, float64(count.Value), count.Chain, count.Processor, count.Name)
+		}
+	}
+}
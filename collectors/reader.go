@@ -3,34 +3,101 @@ package collectors
 import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/ydgo/k2es/group"
+	"strconv"
 )
 
-type collector struct {
-	group        *group.Group
-	bytesCounter prometheus.Counter
+type readerCollector struct {
+	group         *group.Group
+	messages      *prometheus.Desc
+	bytes         *prometheus.Desc
+	fetches       *prometheus.Desc
+	errors        *prometheus.Desc
+	timeouts      *prometheus.Desc
+	rebalances    *prometheus.Desc
+	restarts      *prometheus.Desc
+	queueLength   *prometheus.Desc
+	offset        *prometheus.Desc
+	highWatermark *prometheus.Desc
+	committed     *prometheus.Desc
+	lag           *prometheus.Desc
+	failed        *prometheus.Desc
 }
 
-func NewCounter(group *group.Group) prometheus.Collector {
-	t := prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "k2es",
-		Subsystem: "reader",
-		Name:      "bytes_total",
-		Help:      "The total number of bytes read",
-	})
-	return &collector{
-		group:        group,
-		bytesCounter: t,
+// NewReaderCollector exports the counters of the kafka reader of each consumer and the
+// offsets of each partition assigned to or fetched by the group.
+func NewReaderCollector(group *group.Group) prometheus.Collector {
+	fqName := func(name string) string {
+		return "k2es_reader_" + name
+	}
+	readerLabels := []string{"client_id"}
+	partitionLabels := []string{"topic", "partition"}
+	return &readerCollector{
+		group: group,
+		messages: prometheus.NewDesc(fqName("messages_total"),
+			"The number of messages read", readerLabels, nil),
+		bytes: prometheus.NewDesc(fqName("bytes_total"),
+			"The total number of bytes read", readerLabels, nil),
+		fetches: prometheus.NewDesc(fqName("fetches_total"),
+			"The number of fetch requests", readerLabels, nil),
+		errors: prometheus.NewDesc(fqName("errors_total"),
+			"The number of fetch errors", readerLabels, nil),
+		timeouts: prometheus.NewDesc(fqName("timeouts_total"),
+			"The number of fetch timeouts", readerLabels, nil),
+		rebalances: prometheus.NewDesc(fqName("rebalances_total"),
+			"The number of consumer group rebalances", readerLabels, nil),
+		restarts: prometheus.NewDesc(fqName("restarts_total"),
+			"The number of reader restarts to consume the failed messages again", readerLabels, nil),
+		queueLength: prometheus.NewDesc(fqName("queue_length"),
+			"The number of messages fetched and waiting in the reader queue", readerLabels, nil),
+		offset: prometheus.NewDesc(fqName("offset"),
+			"The offset of the last fetched message of the partition", partitionLabels, nil),
+		highWatermark: prometheus.NewDesc(fqName("high_watermark"),
+			"The high watermark of the partition read from the brokers", partitionLabels, nil),
+		committed: prometheus.NewDesc(fqName("committed_offset"),
+			"The offset committed to the consumer group for the partition", partitionLabels, nil),
+		lag: prometheus.NewDesc(fqName("lag"),
+			"The number of messages of the partition after the committed offset", partitionLabels, nil),
+		failed: prometheus.NewDesc(fqName("failed_messages"),
+			"The number of messages of the partition that failed, its offset is not committed past the first one and the reader is restarted to consume it again", partitionLabels, nil),
 	}
 }
 
-func (c *collector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.bytesCounter.Desc()
+func (c *readerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.messages
+	ch <- c.bytes
+	ch <- c.fetches
+	ch <- c.errors
+	ch <- c.timeouts
+	ch <- c.rebalances
+	ch <- c.restarts
+	ch <- c.queueLength
+	ch <- c.offset
+	ch <- c.highWatermark
+	ch <- c.committed
+	ch <- c.lag
+	ch <- c.failed
 }
 
-func (c *collector) Collect(ch chan<- prometheus.Metric) {
+func (c *readerCollector) Collect(ch chan<- prometheus.Metric) {
 	stats := c.group.Stats()
-	for _, stat := range stats.Readers {
-		c.bytesCounter.Add(float64(stat.Bytes))
+	for _, reader := range stats.Readers {
+		ch <- prometheus.MustNewConstMetric(c.messages, prometheus.CounterValue, float64(reader.Messages), reader.ClientID)
+		ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.CounterValue, float64(reader.Bytes), reader.ClientID)
+		ch <- prometheus.MustNewConstMetric(c.fetches, prometheus.CounterValue, float64(reader.Fetches), reader.ClientID)
+		ch <- prometheus.MustNewConstMetric(c.errors, prometheus.CounterValue, float64(reader.Errors), reader.ClientID)
+		ch <- prometheus.MustNewConstMetric(c.timeouts, prometheus.CounterValue, float64(reader.Timeouts), reader.ClientID)
+		ch <- prometheus.MustNewConstMetric(c.rebalances, prometheus.CounterValue, float64(reader.Rebalances), reader.ClientID)
+		ch <- prometheus.MustNewConstMetric(c.restarts, prometheus.CounterValue, float64(reader.Restarts), reader.ClientID)
+		ch <- prometheus.MustNewConstMetric(c.queueLength, prometheus.GaugeValue, float64(reader.QueueLength), reader.ClientID)
+	}
+	for _, p := range stats.Partitions {
+		partition := strconv.Itoa(p.Partition)
+		ch <- prometheus.MustNewConstMetric(c.offset, prometheus.GaugeValue, float64(p.Offset), p.Topic, partition)
+		ch <- prometheus.MustNewConstMetric(c.highWatermark, prometheus.GaugeValue, float64(p.HighWatermark), p.Topic, partition)
+		if p.Committed >= 0 {
+			ch <- prometheus.MustNewConstMetric(c.committed, prometheus.GaugeValue, float64(p.Committed), p.Topic, partition)
+		}
+		ch <- prometheus.MustNewConstMetric(c.lag, prometheus.GaugeValue, float64(p.Lag), p.Topic, partition)
+		ch <- prometheus.MustNewConstMetric(c.failed, prometheus.GaugeValue, float64(p.Failed), p.Topic, partition)
 	}
-	ch <- c.bytesCounter
 }
@@ -0,0 +1,97 @@
+package collectors
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+	"github.com/ydgo/k2es/group"
+	"github.com/ydgo/k2es/indexer"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gather returns the value of the counters of the reader collector by metric and client id.
+func gather(t *testing.T, reg *prometheus.Registry) map[string]map[string]float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if metric.GetCounter() == nil {
+				continue
+			}
+			for _, label := range metric.GetLabel() {
+				if label.GetName() != "client_id" {
+					continue
+				}
+				if values[family.GetName()] == nil {
+					values[family.GetName()] = make(map[string]float64)
+				}
+				values[family.GetName()][label.GetValue()] = metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func TestReaderCollector(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the readers fail to reach the broker, their fetch errors are counted
+	g, err := group.NewGroup(ctx, group.Config{
+		Indexer:     indexer.NewIndexerMgmt(ctx, indexer.Config{}),
+		Consumers:   2,
+		GroupID:     "k2es",
+		GroupTopics: []string{"logs"},
+		Brokers:     []string{"127.0.0.1:1"},
+		ClientID:    "k2es",
+		MinBytes:    1,
+		MaxBytes:    1e6,
+		StartOffset: kafka.FirstOffset,
+		ErrorLogger: kafka.LoggerFunc(func(string, ...interface{}) {}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close(context.Background())
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewReaderCollector(g))
+
+	previous := gather(t, reg)
+	for _, name := range []string{"k2es_reader_messages_total", "k2es_reader_errors_total", "k2es_reader_restarts_total"} {
+		if len(previous[name]) != 2 {
+			t.Errorf("%s of %d consumers, want 2", name, len(previous[name]))
+		}
+	}
+	// the stats read concurrently by another caller are still exported
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				g.Stats()
+				time.Sleep(5 * time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+	current := gather(t, reg)
+	for name, clients := range previous {
+		for client, value := range clients {
+			if current[name][client] < value {
+				t.Errorf("%s{client_id=%q} decreased from %v to %v", name, client, value, current[name][client])
+			}
+		}
+	}
+	stats := g.Stats()
+	for _, reader := range stats.Readers {
+		if current["k2es_reader_errors_total"][reader.ClientID] > float64(reader.Errors) {
+			t.Errorf("errors of %s = %d, want at least the %v exported", reader.ClientID, reader.Errors, current["k2es_reader_errors_total"][reader.ClientID])
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package collectors
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ydgo/k2es/indexer"
+)
+
+type spoolCollector struct {
+	spool    *indexer.Spool
+	segments *prometheus.Desc
+	bytes    *prometheus.Desc
+	actions  *prometheus.Desc
+}
+
+func NewSpoolCollector(spool *indexer.Spool) prometheus.Collector {
+	fqName := func(name string) string {
+		return "k2es_spool_" + name
+	}
+	return &spoolCollector{
+		spool: spool,
+		segments: prometheus.NewDesc(fqName("segments"),
+			"The number of spool segment files waiting for replay", nil, nil),
+		bytes: prometheus.NewDesc(fqName("bytes"),
+			"The size of the spool in bytes", nil, nil),
+		actions: prometheus.NewDesc(fqName("actions"),
+			"The number of bulk actions waiting for replay", nil, nil),
+	}
+}
+
+func (c *spoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.segments
+	ch <- c.bytes
+	ch <- c.actions
+}
+
+func (c *spoolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.spool.Stats()
+	ch <- prometheus.MustNewConstMetric(c.segments, prometheus.GaugeValue, float64(stats.Segments))
+	ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(stats.Bytes))
+	ch <- prometheus.MustNewConstMetric(c.actions, prometheus.GaugeValue, float64(stats.Actions))
+}
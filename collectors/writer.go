@@ -7,35 +7,38 @@ import (
 
 type writerCollector struct {
 	mgmt     *indexer.Mgmt
-	index    string
 	added    *prometheus.Desc
 	flushed  *prometheus.Desc
 	indexed  *prometheus.Desc
+	created  *prometheus.Desc
 	failed   *prometheus.Desc
 	requests *prometheus.Desc
+	fallback *prometheus.Desc
 }
 
-func NewWriterCollector(index string, mgmt *indexer.Mgmt) prometheus.Collector {
+// NewWriterCollector exports the stats of each open indexer of mgmt, the series of an
+// index disappear once its idle indexer is closed.
+func NewWriterCollector(mgmt *indexer.Mgmt) prometheus.Collector {
 	fqName := func(name string) string {
-		return "es_writer_" + name
+		return "k2es_writer_" + name
 	}
+	labels := []string{"index", "pipeline"}
 	return &writerCollector{
-		index: index,
-		mgmt:  mgmt,
-		added: prometheus.NewDesc(fqName("added"),
-			"The number of added", nil, prometheus.Labels{"index": index}),
-		flushed: prometheus.NewDesc(
-			fqName("flushed"),
-			"The number of flushed", nil, prometheus.Labels{"index": index}),
-		indexed: prometheus.NewDesc(
-			fqName("indexed"),
-			"The number of indexed", nil, prometheus.Labels{"index": index}),
-		failed: prometheus.NewDesc(
-			fqName("failed"),
-			"The number of failed", nil, prometheus.Labels{"index": index}),
-		requests: prometheus.NewDesc(
-			fqName("requests"),
-			"The number of requests", nil, prometheus.Labels{"index": index}),
+		mgmt: mgmt,
+		added: prometheus.NewDesc(fqName("added_total"),
+			"The number of documents added to the bulk indexer", labels, nil),
+		flushed: prometheus.NewDesc(fqName("flushed_total"),
+			"The number of documents written by elasticsearch", labels, nil),
+		indexed: prometheus.NewDesc(fqName("indexed_total"),
+			"The number of documents written with the index action", labels, nil),
+		created: prometheus.NewDesc(fqName("created_total"),
+			"The number of documents written with the create action", labels, nil),
+		failed: prometheus.NewDesc(fqName("failed_total"),
+			"The number of documents failed, including the retried ones", labels, nil),
+		requests: prometheus.NewDesc(fqName("requests_total"),
+			"The number of bulk requests", labels, nil),
+		fallback: prometheus.NewDesc(fqName("id_fallback_total"),
+			"The number of documents whose id is generated by elasticsearch, as the id strategy could not derive it", []string{"topic"}, nil),
 	}
 }
 
@@ -43,15 +46,22 @@ func (c *writerCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.added
 	ch <- c.flushed
 	ch <- c.indexed
+	ch <- c.created
 	ch <- c.failed
 	ch <- c.requests
+	ch <- c.fallback
 }
 
 func (c *writerCollector) Collect(ch chan<- prometheus.Metric) {
-	stats := c.mgmt.Stats()
-	ch <- prometheus.MustNewConstMetric(c.added, prometheus.GaugeValue, float64(stats.NumAdded))
-	ch <- prometheus.MustNewConstMetric(c.flushed, prometheus.GaugeValue, float64(stats.NumFlushed))
-	ch <- prometheus.MustNewConstMetric(c.indexed, prometheus.GaugeValue, float64(stats.NumIndexed))
-	ch <- prometheus.MustNewConstMetric(c.failed, prometheus.GaugeValue, float64(stats.NumFailed))
-	ch <- prometheus.MustNewConstMetric(c.requests, prometheus.GaugeValue, float64(stats.NumRequests))
+	for _, stats := range c.mgmt.IndexStats() {
+		ch <- prometheus.MustNewConstMetric(c.added, prometheus.CounterValue, float64(stats.NumAdded), stats.Index, stats.Pipeline)
+		ch <- prometheus.MustNewConstMetric(c.flushed, prometheus.CounterValue, float64(stats.NumFlushed), stats.Index, stats.Pipeline)
+		ch <- prometheus.MustNewConstMetric(c.indexed, prometheus.CounterValue, float64(stats.NumIndexed), stats.Index, stats.Pipeline)
+		ch <- prometheus.MustNewConstMetric(c.created, prometheus.CounterValue, float64(stats.NumCreated), stats.Index, stats.Pipeline)
+		ch <- prometheus.MustNewConstMetric(c.failed, prometheus.CounterValue, float64(stats.NumFailed), stats.Index, stats.Pipeline)
+		ch <- prometheus.MustNewConstMetric(c.requests, prometheus.CounterValue, float64(stats.NumRequests), stats.Index, stats.Pipeline)
+	}
+	for topic, n := range c.mgmt.IDFallbacks() {
+		ch <- prometheus.MustNewConstMetric(c.fallback, prometheus.CounterValue, float64(n), topic)
+	}
 }
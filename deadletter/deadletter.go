@@ -0,0 +1,124 @@
+package deadletter
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"strconv"
+	"time"
+)
+
+// headers added to every dead letter message
+const (
+	HeaderTopic       = "k2es-source-topic"
+	HeaderPartition   = "k2es-source-partition"
+	HeaderOffset      = "k2es-source-offset"
+	HeaderIndex       = "k2es-index"
+	HeaderErrorType   = "k2es-error-type"
+	HeaderErrorReason = "k2es-error-reason"
+	HeaderTimestamp   = "k2es-timestamp"
+)
+
+// Writer produces the documents rejected by elasticsearch to a dead letter topic,
+// so they can be replayed once the cause is fixed.
+type Writer struct {
+	writer *kafka.Writer
+}
+
+type Config struct {
+	Brokers      []string
+	Topic        string
+	ClientID     string
+	BatchTimeout time.Duration  // Default: 10ms
+	WriteTimeout time.Duration  // Default: 10s
+	TLS          *tls.Config    // nil disables tls
+	SASL         sasl.Mechanism // nil disables sasl
+}
+
+func (cfg Config) Validate() error {
+	if len(cfg.Brokers) == 0 {
+		return fmt.Errorf("dead letter brokers is required")
+	}
+	if len(cfg.Topic) == 0 {
+		return fmt.Errorf("dead letter topic is required")
+	}
+	return nil
+}
+
+func NewWriter(cfg Config) (*Writer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("validation: %w", err)
+	}
+	if cfg.BatchTimeout <= 0 {
+		cfg.BatchTimeout = 10 * time.Millisecond
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = 10 * time.Second
+	}
+	return &Writer{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Brokers...),
+			Topic:        cfg.Topic,
+			Balancer:     &kafka.Hash{},
+			BatchTimeout: cfg.BatchTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+			RequiredAcks: kafka.RequireAll,
+			Transport:    &kafka.Transport{ClientID: cfg.ClientID, TLS: cfg.TLS, SASL: cfg.SASL},
+		},
+	}, nil
+}
+
+// Rejection describes why elasticsearch rejected a document.
+type Rejection struct {
+	Index       string
+	ErrorType   string
+	ErrorReason string
+}
+
+type originalKey struct{}
+
+// WithOriginal returns a context carrying msg as it was consumed from kafka, before it was
+// converted, decoded or processed.
+func WithOriginal(ctx context.Context, msg kafka.Message) context.Context {
+	return context.WithValue(ctx, originalKey{}, msg)
+}
+
+// Original returns the message of ctx as it was consumed from kafka, msg when ctx has none.
+func Original(ctx context.Context, msg kafka.Message) kafka.Message {
+	if original, ok := ctx.Value(originalKey{}).(kafka.Message); ok {
+		return original
+	}
+	return msg
+}
+
+// Send produces the original message of ctx, msg when ctx has none, with the rejection headers
+// in the background, done is called with the result of the write.
+func (w *Writer) Send(ctx context.Context, msg kafka.Message, rejection Rejection, done func(error)) {
+	msg = Original(ctx, msg)
+	headers := make([]kafka.Header, 0, len(msg.Headers)+7)
+	headers = append(headers, msg.Headers...)
+	headers = append(headers,
+		kafka.Header{Key: HeaderTopic, Value: []byte(msg.Topic)},
+		kafka.Header{Key: HeaderPartition, Value: []byte(strconv.Itoa(msg.Partition))},
+		kafka.Header{Key: HeaderOffset, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		kafka.Header{Key: HeaderIndex, Value: []byte(rejection.Index)},
+		kafka.Header{Key: HeaderErrorType, Value: []byte(rejection.ErrorType)},
+		kafka.Header{Key: HeaderErrorReason, Value: []byte(rejection.ErrorReason)},
+		kafka.Header{Key: HeaderTimestamp, Value: []byte(time.Now().Format(time.RFC3339Nano))},
+	)
+	go func() {
+		// concurrent writes are batched by the kafka writer
+		done(w.writer.WriteMessages(context.Background(), kafka.Message{
+			Key:     msg.Key,
+			Value:   msg.Value,
+			Headers: headers,
+		}))
+	}()
+}
+
+// Close flushes pending messages and closes the writer.
+func (w *Writer) Close() error {
+	return w.writer.Close()
+}
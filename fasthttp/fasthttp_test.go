@@ -0,0 +1,292 @@
+package fasthttp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/ydgo/k2es/data"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	benchURL      = flag.String("url", "", "elasticsearch url of BenchmarkTransport, an in-process stub when empty")
+	benchIndex    = flag.String("index", "k2es-bench", "index of the documents of BenchmarkTransport")
+	benchDocs     = flag.Int("docs", 1000, "documents per bulk request of BenchmarkTransport")
+	benchCompress = flag.Bool("compress", true, "gzip the request bodies of BenchmarkTransport")
+)
+
+func newClient(t *testing.T, handler http.HandlerFunc, cfg Config, compress bool) *elasticsearch.Client {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	transport, err := NewTransport(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses:           []string{server.URL},
+		Transport:           transport,
+		DisableRetry:        true,
+		CompressRequestBody: compress,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return es
+}
+
+func TestTransportRequestBody(t *testing.T) {
+	body, err := bulkBody("logs", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, compress := range []bool{false, true} {
+		var received []byte
+		var encoding string
+		es := newClient(t, func(w http.ResponseWriter, r *http.Request) {
+			encoding = r.Header.Get("Content-Encoding")
+			var reader io.Reader = r.Body
+			if encoding == "gzip" {
+				gz, err := gzip.NewReader(r.Body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				reader = gz
+			}
+			received, _ = io.ReadAll(reader)
+			_, _ = io.WriteString(w, `{"errors":false,"items":[]}`)
+		}, Config{}, compress)
+		if err := bulk(es, body); err != nil {
+			t.Fatalf("compress %t: %s", compress, err)
+		}
+		if compress != (encoding == "gzip") {
+			t.Errorf("compress %t: content encoding %q", compress, encoding)
+		}
+		if !bytes.Equal(received, body) {
+			t.Errorf("compress %t: received %d bytes, want %d", compress, len(received), len(body))
+		}
+	}
+}
+
+func TestTransportCompressedResponse(t *testing.T) {
+	want := `{"took":1,"errors":false,"items":[]}`
+	es := newClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			_, _ = io.WriteString(w, want)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		_, _ = io.WriteString(gz, want)
+		_ = gz.Close()
+	}, Config{}, false)
+	res, err := esapi.BulkRequest{Body: strings.NewReader("{}\n")}.Do(context.Background(), es)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	got, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+	if encoding := res.Header.Get("Content-Encoding"); encoding != "" {
+		t.Errorf("content encoding %q of the decompressed body", encoding)
+	}
+}
+
+func TestTransportTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+	}
+	tests := []struct {
+		name    string
+		cfg     Config
+		timeout time.Duration // of the request context, none when 0
+		cancel  bool          // cancels the request context
+		want    error
+	}{
+		{name: "context deadline", timeout: 50 * time.Millisecond, want: context.DeadlineExceeded},
+		{name: "context canceled", cancel: true, want: context.Canceled},
+		{name: "read timeout", cfg: Config{ReadTimeout: 50 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		es := newClient(t, slow, tt.cfg, false)
+		ctx, cancel := context.WithCancel(context.Background())
+		if tt.timeout > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), tt.timeout)
+		}
+		if tt.cancel {
+			time.AfterFunc(50*time.Millisecond, cancel)
+		}
+		start := time.Now()
+		res, err := esapi.InfoRequest{}.Do(ctx, es)
+		cancel()
+		if err == nil {
+			res.Body.Close()
+			t.Errorf("%s: no error", tt.name)
+			continue
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.want)
+		}
+		if took := time.Since(start); took > time.Second {
+			t.Errorf("%s: took %s", tt.name, took)
+		}
+	}
+}
+
+// BenchmarkTransport compares the net/http and fasthttp transports of the elasticsearch client
+// sending bulk requests of data.TestMessage documents, against an elasticsearch stub answering
+// like the bulk api or against a real cluster with -url.
+//
+//	go test ./fasthttp -run - -bench Transport -cpu 8 -args -docs 1000 -compress
+func BenchmarkTransport(b *testing.B) {
+	address := *benchURL
+	if address == "" {
+		stub := httptest.NewServer(http.HandlerFunc(bulkStub))
+		defer stub.Close()
+		address = stub.URL
+	}
+	body, err := bulkBody(*benchIndex, *benchDocs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	fast, err := NewTransport(Config{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	transports := []struct {
+		name      string
+		transport http.RoundTripper
+	}{
+		{"net/http", http.DefaultTransport.(*http.Transport).Clone()},
+		{"fasthttp", fast},
+	}
+	for _, t := range transports {
+		es, err := elasticsearch.NewClient(elasticsearch.Config{
+			Addresses:           []string{address},
+			Transport:           t.transport,
+			DisableRetry:        true,
+			CompressRequestBody: *benchCompress,
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(t.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := bulk(es, body); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func bulk(es *elasticsearch.Client, body []byte) error {
+	res, err := esapi.BulkRequest{Body: bytes.NewReader(body)}.Do(context.Background(), es)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("bulk: %s", res.String())
+	}
+	// the bulk indexer decodes the whole response
+	_, err = io.Copy(io.Discard, res.Body)
+	return err
+}
+
+// bulkBody returns the ndjson bulk request of n documents, the indented test message is
+// compacted into a single line.
+func bulkBody(index string, n int) ([]byte, error) {
+	var doc bytes.Buffer
+	if err := json.Compact(&doc, []byte(data.TestMessage)); err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	action := fmt.Sprintf(`{"index":{"_index":%q}}`, index)
+	for i := 0; i < n; i++ {
+		body.WriteString(action)
+		body.WriteByte('\n')
+		body.Write(doc.Bytes())
+		body.WriteByte('\n')
+	}
+	return body.Bytes(), nil
+}
+
+// bulkStub answers the bulk requests with an item per action, like elasticsearch.
+func bulkStub(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+		_, _ = io.WriteString(w, `{"version":{"number":"7.17.10"},"tagline":"You Know, for Search"}`)
+		return
+	}
+	var reader io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	actions := make([]string, 0)
+	for scanner.Scan() {
+		var meta map[string]json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &meta); err != nil || len(meta) != 1 {
+			http.Error(w, fmt.Sprintf("invalid action line %d", len(actions)+1), http.StatusBadRequest)
+			return
+		}
+		for action := range meta {
+			actions = append(actions, action)
+		}
+		// every action but delete is followed by its source
+		if actions[len(actions)-1] != "delete" && !scanner.Scan() {
+			http.Error(w, "missing source line", http.StatusBadRequest)
+			return
+		}
+	}
+	var res bytes.Buffer
+	res.WriteString(`{"took":1,"errors":false,"items":[`)
+	for i, action := range actions {
+		if i > 0 {
+			res.WriteByte(',')
+		}
+		fmt.Fprintf(&res, `{%q:{"_index":%q,"_id":"%d","_version":1,"result":"created","status":201}}`, action, *benchIndex, i)
+	}
+	res.WriteString(`]}`)
+	_, _ = w.Write(res.Bytes())
+}
@@ -0,0 +1,108 @@
+package flow
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Budget limits the bytes of the messages fetched from kafka and not yet acknowledged
+// by elasticsearch, it is shared by all consumers so that a slow cluster stops the fetching
+// instead of piling up messages in the bulk indexers.
+type Budget struct {
+	max int64
+
+	mux      sync.Mutex
+	inFlight int64
+	released chan struct{} // closed on every release
+	blocks   uint64
+	blocked  time.Duration
+}
+
+type Stats struct {
+	MaxBytes      int64
+	InFlightBytes int64
+	Blocks        uint64        // number of acquisitions that waited
+	Blocked       time.Duration // total time spent waiting
+}
+
+func NewBudget(maxBytes int64) *Budget {
+	return &Budget{
+		max:      maxBytes,
+		released: make(chan struct{}),
+	}
+}
+
+// Acquire waits until n bytes fit in the budget. A message larger than the budget is
+// admitted alone, so that it can not block the consumers forever.
+func (b *Budget) Acquire(ctx context.Context, n int64) error {
+	b.mux.Lock()
+	if b.fits(n) {
+		b.inFlight += n
+		b.mux.Unlock()
+		return nil
+	}
+	b.blocks++
+	start := time.Now()
+	for !b.fits(n) {
+		released := b.released
+		b.mux.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			b.mux.Lock()
+			b.blocked += time.Since(start)
+			b.mux.Unlock()
+			return ctx.Err()
+		}
+		b.mux.Lock()
+	}
+	b.inFlight += n
+	b.blocked += time.Since(start)
+	b.mux.Unlock()
+	return nil
+}
+
+// ReaderMaxBytes returns maxBytes lowered so that the messages prefetched by the readers of
+// consumers, about two fetches each: one queued and one being read, take at most a quarter of
+// the budget. It returns maxBytes when the budget is nil, 0 is the 1MB default of the readers.
+func (b *Budget) ReaderMaxBytes(consumers, maxBytes int) int {
+	if b == nil || consumers <= 0 {
+		return maxBytes
+	}
+	if maxBytes <= 0 {
+		maxBytes = 1e6
+	}
+	limit := b.max / 4 / int64(2*consumers)
+	if limit < 1 {
+		limit = 1
+	}
+	if int64(maxBytes) > limit {
+		return int(limit)
+	}
+	return maxBytes
+}
+
+func (b *Budget) fits(n int64) bool {
+	return b.inFlight == 0 || b.inFlight+n <= b.max
+}
+
+// Release gives back n bytes acquired before and wakes up the waiting consumers.
+func (b *Budget) Release(n int64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.inFlight -= n
+	close(b.released)
+	b.released = make(chan struct{})
+}
+
+func (b *Budget) Stats() Stats {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return Stats{
+		MaxBytes:      b.max,
+		InFlightBytes: b.inFlight,
+		Blocks:        b.blocks,
+		Blocked:       b.blocked,
+	}
+}
@@ -0,0 +1,77 @@
+package flow
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	b := NewBudget(10)
+	ctx := context.Background()
+	if err := b.Acquire(ctx, 6); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Acquire(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- b.Acquire(ctx, 5)
+	}()
+	select {
+	case err := <-acquired:
+		t.Fatalf("acquired beyond the budget: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	b.Release(4)
+	select {
+	case <-acquired:
+		t.Fatal("acquired 5 bytes with 4 available")
+	case <-time.After(20 * time.Millisecond):
+	}
+	b.Release(6)
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+	stats := b.Stats()
+	if stats.InFlightBytes != 5 || stats.Blocks != 1 || stats.Blocked <= 0 {
+		t.Errorf("stats = %+v, want 5 bytes in flight after 1 block", stats)
+	}
+	// a message larger than the budget is admitted alone
+	b.Release(5)
+	if err := b.Acquire(ctx, 20); err != nil {
+		t.Fatal(err)
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := b.Acquire(canceled, 1); err != context.Canceled {
+		t.Errorf("acquire canceled = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestReaderMaxBytes(t *testing.T) {
+	tests := []struct {
+		name      string
+		budget    *Budget
+		consumers int
+		maxBytes  int
+		want      int
+	}{
+		{"no budget", nil, 8, 6e6, 6e6},
+		{"within the budget", NewBudget(256 << 20), 8, 1e6, 1e6},
+		{"lowered", NewBudget(256 << 20), 8, 6e6, 4 << 20},
+		{"default lowered", NewBudget(32 << 20), 8, 0, 512 << 10},
+		{"default", NewBudget(256 << 20), 8, 0, 1e6},
+		{"tiny budget", NewBudget(10), 8, 1e6, 1},
+	}
+	for _, tt := range tests {
+		if got := tt.budget.ReaderMaxBytes(tt.consumers, tt.maxBytes); got != tt.want {
+			t.Errorf("%s: max bytes = %d, want %d", tt.name, got, tt.want)
+		}
+		// prefetch of two fetches per consumer
+		if tt.budget != nil && tt.want > 1 && int64(2*tt.consumers*tt.want) > tt.budget.max/4 {
+			t.Errorf("%s: prefetch of %d bytes beyond a quarter of the budget", tt.name, 2*tt.consumers*tt.want)
+		}
+	}
+}
@@ -2,10 +2,18 @@ package group
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/ydgo/k2es/breaker"
+	"github.com/ydgo/k2es/charset"
+	"github.com/ydgo/k2es/codec"
+	"github.com/ydgo/k2es/deadletter"
+	"github.com/ydgo/k2es/flow"
 	"github.com/ydgo/k2es/indexer"
+	"github.com/ydgo/k2es/processor"
 	"io"
 	"log"
 	"sync"
@@ -13,15 +21,31 @@ import (
 )
 
 type consumer struct {
-	reader  *kafka.Reader
-	handler func(ctx context.Context, message kafka.Message) error
+	config         kafka.ReaderConfig
+	mux            sync.Mutex    // for reader and stats
+	reader         *kafka.Reader // replaced by restart
+	stats          ReaderStats   // cumulative, kept by addStats
+	offsets        *offsets
+	partitions     *partitions
+	budget         *flow.Budget
+	breaker        *breaker.Breaker
+	commitInterval time.Duration
+	handler        func(ctx context.Context, message kafka.Message, ack func(error)) error
 }
 
 type Group struct {
-	ctx       context.Context
-	wg        sync.WaitGroup
-	consumers []*consumer
-	indexer   *indexer.Mgmt
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup // fetch loops
+	commits    sync.WaitGroup // commit loops
+	done       chan struct{}  // stops the commit loops
+	consumers  []*consumer
+	partitions *partitions
+	indexer    *indexer.Mgmt
+	client     *kafka.Client
+	transport  *kafka.Transport
+	groupID    string
+	member     []byte // user data identifying the consumers of the process in the group
 }
 
 func NewGroup(ctx context.Context, config Config) (*Group, error) {
@@ -32,39 +56,105 @@ func NewGroup(ctx context.Context, config Config) (*Group, error) {
 	if config.Consumers <= 0 {
 		config.Consumers = 1
 	}
+	if config.CommitInterval <= 0 {
+		config.CommitInterval = time.Second
+	}
+	if config.LagInterval <= 0 {
+		config.LagInterval = 30 * time.Second
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = 1e6
+	}
+	member, err := newMember()
+	if err != nil {
+		return nil, fmt.Errorf("member id: %w", err)
+	}
+	transport := &kafka.Transport{
+		ClientID:    config.ClientID,
+		DialTimeout: 10 * time.Second,
+		TLS:         config.TLS,
+		SASL:        config.SASL,
+	}
 
+	handler := config.Indexer.Handle
+	if config.Processors != nil {
+		handler = processor.NewHandler(config.Processors, handler).Handle
+	}
+	if config.Codecs != nil {
+		handler = codec.NewHandler(config.Codecs, handler).Handle
+	}
+	if config.Charsets != nil {
+		handler = charset.NewHandler(config.Charsets, handler).Handle
+	}
+	// the messages prefetched by the readers are not in the budget, their fetches are bounded by it
+	if maxBytes := config.Budget.ReaderMaxBytes(config.Consumers, config.MaxBytes); maxBytes != config.MaxBytes {
+		log.Printf("kafka max_bytes lowered to %d, the fetches of the %d consumers are bounded by the in-flight bytes", maxBytes, config.Consumers)
+		config.MaxBytes = maxBytes
+		if config.MinBytes > maxBytes {
+			config.MinBytes = maxBytes
+		}
+	}
+	partitions := newPartitions()
 	consumers := make([]*consumer, 0)
 	for i := 0; i < config.Consumers; i++ {
+		readerConfig := kafka.ReaderConfig{
+			Brokers:     config.Brokers,
+			GroupID:     config.GroupID,
+			GroupTopics: config.GroupTopics,
+			Dialer: &kafka.Dialer{
+				ClientID:      fmt.Sprintf("%s-%02d", config.ClientID, i+1),
+				Timeout:       10 * time.Second,
+				DualStack:     true,
+				TLS:           config.TLS,
+				SASLMechanism: config.SASL,
+			},
+			QueueCapacity:          config.QueueCapacity,
+			MinBytes:               config.MinBytes,
+			MaxBytes:               config.MaxBytes,
+			MaxWait:                config.MaxWait,
+			ReadBatchTimeout:       config.ReadBatchTimeout,
+			PartitionWatchInterval: config.PartitionWatchInterval,
+			WatchPartitionChanges:  config.WatchPartitionChanges,
+			StartOffset:            config.StartOffset,
+			GroupBalancers: []kafka.GroupBalancer{
+				memberBalancer{GroupBalancer: kafka.RangeGroupBalancer{}, member: member},
+				memberBalancer{GroupBalancer: kafka.RoundRobinGroupBalancer{}, member: member},
+			},
+			ErrorLogger: config.ErrorLogger,
+		}
 		consumers = append(consumers, &consumer{
-			reader: kafka.NewReader(kafka.ReaderConfig{
-				Brokers:                config.Brokers,
-				GroupID:                config.GroupID,
-				GroupTopics:            config.GroupTopics,
-				Dialer:                 &kafka.Dialer{ClientID: fmt.Sprintf("%s-%02d", config.ClientID, i+1)},
-				QueueCapacity:          config.QueueCapacity,
-				MinBytes:               config.MinBytes,
-				MaxBytes:               config.MaxBytes,
-				MaxWait:                config.MaxWait,
-				ReadBatchTimeout:       config.ReadBatchTimeout,
-				CommitInterval:         config.CommitInterval,
-				PartitionWatchInterval: config.PartitionWatchInterval,
-				WatchPartitionChanges:  config.WatchPartitionChanges,
-				StartOffset:            config.StartOffset,
-				ErrorLogger:            config.ErrorLogger,
-			}),
-			handler: config.BlukIndexer.Handle,
+			config:         readerConfig,
+			reader:         kafka.NewReader(readerConfig),
+			offsets:        newOffsets(),
+			partitions:     partitions,
+			budget:         config.Budget,
+			breaker:        config.Breaker,
+			commitInterval: config.CommitInterval,
+			handler:        handler,
 		})
 	}
 	group := &Group{
-		ctx:       ctx,
-		consumers: consumers,
-		indexer:   config.Indexer,
+		done:       make(chan struct{}),
+		consumers:  consumers,
+		partitions: partitions,
+		indexer:    config.Indexer,
+		client:     &kafka.Client{Addr: kafka.TCP(config.Brokers...), Transport: transport},
+		transport:  transport,
+		groupID:    config.GroupID,
+		member:     member,
 	}
+	group.ctx, group.cancel = context.WithCancel(ctx)
+	go group.watchLag(config.LagInterval)
 	for _, c := range group.consumers {
+		group.commits.Add(1)
+		go func(c *consumer) {
+			defer group.commits.Done()
+			c.commitLoop(group.done)
+		}(c)
 		group.wg.Add(1)
 		go func(c *consumer) {
 			defer group.wg.Done()
-			err = c.run(group.ctx)
+			err := c.run(group.ctx)
 			if err != nil {
 				log.Printf("run: %s", err)
 			}
@@ -75,19 +165,26 @@ func NewGroup(ctx context.Context, config Config) (*Group, error) {
 
 type Config struct {
 	Indexer                *indexer.Mgmt
-	BlukIndexer            *indexer.Indexer
-	Consumers              int // Default: 1
+	Budget                 *flow.Budget                          // 所有 consumer 共享的在途字节数限制, 为 nil 时不限制
+	Breaker                *breaker.Breaker                      // es 不可写入时暂停所有 consumer, 为 nil 时不暂停
+	Processors             func(topic string) *processor.Chain   // 写入 es 前处理消息, 为 nil 时不处理
+	Codecs                 func(topic string) *codec.Decoder     // 将消息解码为 json, 为 nil 时消息均为 json
+	Charsets               func(topic string) *charset.Converter // 解码前将消息转换为 utf-8, 为 nil 时不转换
+	Consumers              int                                   // Default: 1
 	GroupID                string
 	GroupTopics            []string
 	Brokers                []string
 	ClientID               string
-	QueueCapacity          int           //  Default: 100
-	MinBytes               int           // Default: 1B
-	MaxBytes               int           // Default: 1MB
-	MaxWait                time.Duration // Default: 10s
-	ReadBatchTimeout       time.Duration // 10s
-	CommitInterval         time.Duration // Default: 0
-	PartitionWatchInterval time.Duration // Default: 5s
+	TLS                    *tls.Config    // nil disables tls
+	SASL                   sasl.Mechanism // nil disables sasl
+	QueueCapacity          int            //  Default: 100
+	MinBytes               int            // Default: 1B
+	MaxBytes               int            // Default: 1MB, lowered to fit the fetches of the consumers in Budget
+	MaxWait                time.Duration  // Default: 10s
+	ReadBatchTimeout       time.Duration  // 10s
+	CommitInterval         time.Duration  // 提交已确认 offset 的间隔 Default: 1s
+	LagInterval            time.Duration  // 从 broker 查询分配的分区, 已提交 offset 和 high watermark 的间隔 Default: 30s
+	PartitionWatchInterval time.Duration  // Default: 5s
 	WatchPartitionChanges  bool
 	StartOffset            int64 // Default: FirstOffset
 	ErrorLogger            kafka.Logger
@@ -125,38 +222,233 @@ func (config Config) Validate() error {
 	return nil
 }
 
-// Stop all consumer
+// Stop fetching messages and wait for all consumer,
+// the offsets acknowledged until Close are still committed.
 func (g *Group) Stop() {
+	g.cancel()
 	g.wg.Wait()
 }
 
+// Close commits the last acknowledged offsets and closes the readers.
+func (g *Group) Close(ctx context.Context) {
+	g.Stop()
+	close(g.done)
+	g.commits.Wait()
+	for _, c := range g.consumers {
+		c.commit(ctx)
+		_ = c.getReader().Close()
+	}
+	g.transport.CloseIdleConnections()
+}
+
+// Pending returns the number of messages fetched and not yet acknowledged.
+func (g *Group) Pending() int {
+	pending := 0
+	for _, c := range g.consumers {
+		pending += c.offsets.pending()
+	}
+	return pending
+}
+
 type Stats struct {
-	Readers []kafka.ReaderStats
+	Readers    []ReaderStats
+	Partitions []PartitionStats
+}
+
+// ReaderStats are the cumulative counters of the kafka reader of a consumer.
+type ReaderStats struct {
+	ClientID      string
+	Messages      int64
+	Bytes         int64
+	Fetches       int64
+	Errors        int64 // fetch errors
+	Timeouts      int64
+	Rebalances    int64
+	Restarts      int64 // readers restarted to consume the failed messages again
+	QueueLength   int64
+	QueueCapacity int64
 }
 
+// Stats returns the cumulative reader stats and the partitions, it may be called concurrently.
+// The counters of a kafka reader are reset by each call of its Stats, they are only read by
+// addStats so that none is lost.
 func (g *Group) Stats() Stats {
-	readers := make([]kafka.ReaderStats, 0)
+	readers := make([]ReaderStats, 0, len(g.consumers))
 	for _, c := range g.consumers {
-		readers = append(readers, c.reader.Stats())
+		c.mux.Lock()
+		c.addStats()
+		readers = append(readers, c.stats)
+		c.mux.Unlock()
 	}
 	return Stats{
-		Readers: readers,
+		Readers:    readers,
+		Partitions: g.partitions.stats(),
 	}
 }
 
+// addStats adds the counters of the reader since the last call to the cumulative stats, with
+// c.mux held. It is the only caller of the Stats of the reader, which resets them.
+func (c *consumer) addStats() {
+	stats, totals := c.reader.Stats(), &c.stats
+	totals.ClientID = stats.ClientID
+	totals.Messages += stats.Messages
+	totals.Bytes += stats.Bytes
+	totals.Fetches += stats.Fetches
+	totals.Errors += stats.Errors
+	totals.Timeouts += stats.Timeouts
+	totals.Rebalances += stats.Rebalances
+	totals.QueueLength, totals.QueueCapacity = stats.QueueLength, stats.QueueCapacity
+}
+
+func (c *consumer) getReader() *kafka.Reader {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.reader
+}
+
+// errFailed stops the fetches of a consumer once a message failed.
+var errFailed = errors.New("message failed")
+
+// restartDelay is how long a consumer waits before it joins the group again after a
+// failed message, so that a failing elasticsearch does not rebalance the group continuously.
+const restartDelay = 5 * time.Second
+
 func (c *consumer) run(ctx context.Context) error {
-	defer c.reader.Close()
 	for {
-		msg, err := c.reader.ReadMessage(ctx)
+		err := c.consume(ctx)
+		if !errors.Is(err, errFailed) {
+			return err
+		}
+		if err = c.restart(ctx); err != nil {
+			return nil
+		}
+	}
+}
+
+// restart commits the offsets acknowledged before the failed messages and replaces the reader:
+// the consumer leaves the group and joins it again, the partitions are consumed again from
+// their committed offsets. The offsets fetched since then are not tracked anymore.
+func (c *consumer) restart(ctx context.Context) error {
+	commitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	c.commit(commitCtx)
+	cancel()
+	c.offsets.reset()
+	c.mux.Lock()
+	c.addStats()
+	_ = c.reader.Close()
+	c.stats.Restarts++
+	c.mux.Unlock()
+	log.Printf("%s: messages failed, the reader joins the group again in %s to consume them again", c.config.Dialer.ClientID, restartDelay)
+	timer := time.NewTimer(restartDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	c.mux.Lock()
+	c.reader = kafka.NewReader(c.config)
+	c.mux.Unlock()
+	return nil
+}
+
+// consume handles the messages of the reader until ctx is done, or until a message failed.
+func (c *consumer) consume(ctx context.Context) error {
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.offsets.failures:
+			cancel()
+		case <-fetchCtx.Done():
+		}
+	}()
+	reader := c.getReader()
+	for {
+		if err := c.breaker.Wait(fetchCtx); err != nil {
+			return c.stopped(ctx)
+		}
+		msg, err := reader.FetchMessage(fetchCtx)
 		if err != nil {
 			if errors.Is(err, context.Canceled) || errors.Is(err, io.EOF) {
-				return nil
+				return c.stopped(ctx)
+			}
+			return err
+		}
+		c.partitions.fetched(msg, c.offsets)
+		ack, err := c.acquire(fetchCtx, msg)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return c.stopped(ctx)
 			}
 			return err
 		}
-		err = c.handler(ctx, msg)
+		err = c.handler(deadletter.WithOriginal(ctx, msg), msg, ack)
 		if err != nil {
-			log.Printf("handle: %s", err)
+			// the message will not be acknowledged by the handler, fail it to give its bytes back
+			ack(err)
+			if !errors.Is(err, context.Canceled) {
+				log.Printf("handle: %s", err)
+			}
+		}
+	}
+}
+
+// stopped returns errFailed when the fetches were stopped by a failed message rather than
+// by ctx.
+func (c *consumer) stopped(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return errFailed
+}
+
+// acquire waits for the budget of msg, it returns the acknowledgement function of msg, which
+// gives the budget back whatever the outcome. The handlers call it once the document was
+// indexed, rejected, spooled or failed, including when a bulk request fails as a whole or
+// the indexers are closed.
+func (c *consumer) acquire(ctx context.Context, msg kafka.Message) (func(error), error) {
+	ack := c.offsets.track(msg)
+	if c.budget == nil {
+		return ack, nil
+	}
+	size := int64(len(msg.Value))
+	if err := c.budget.Acquire(ctx, size); err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	return func(err error) {
+		once.Do(func() { c.budget.Release(size) })
+		ack(err)
+	}, nil
+}
+
+// commitLoop periodically commits the offsets acknowledged by elasticsearch until done is closed.
+func (c *consumer) commitLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(c.commitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			c.commit(ctx)
+			cancel()
+		case <-done:
+			return
+		}
+	}
+}
+
+func (c *consumer) commit(ctx context.Context) {
+	msgs := c.offsets.commits()
+	if len(msgs) == 0 {
+		return
+	}
+	if err := c.getReader().CommitMessages(ctx, msgs...); err != nil {
+		if !errors.Is(err, context.Canceled) {
+			log.Printf("commit: %s", err)
 		}
+		return
 	}
+	c.partitions.committed(msgs)
 }
@@ -0,0 +1,121 @@
+package group
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"log"
+	"time"
+)
+
+// memberBalancer sends the id of the process as the user data of the join requests, so that
+// the partitions assigned to its consumers are found in the group description.
+type memberBalancer struct {
+	kafka.GroupBalancer
+	member []byte
+}
+
+func (b memberBalancer) UserData() ([]byte, error) {
+	return b.member, nil
+}
+
+func newMember() ([]byte, error) {
+	member := make([]byte, 16)
+	if _, err := rand.Read(member); err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("k2es-%x", member)), nil
+}
+
+// brokerOffsets are the offsets of an assigned partition read from the brokers.
+type brokerOffsets struct {
+	committed     int64 // -1 before the first commit
+	highWatermark int64
+}
+
+// watchLag reads the partitions assigned to the consumers, their committed offsets and their
+// high watermarks from the brokers every interval, so that the lag of a partition without
+// new fetches is up to date.
+func (g *Group) watchLag(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(g.ctx, interval)
+			offsets, err := g.brokerOffsets(ctx)
+			cancel()
+			if err != nil {
+				log.Printf("partition lag: %s", err)
+				continue
+			}
+			g.partitions.assign(offsets)
+		case <-g.ctx.Done():
+			return
+		}
+	}
+}
+
+func (g *Group) brokerOffsets(ctx context.Context) (map[topicPartition]brokerOffsets, error) {
+	res, err := g.client.DescribeGroups(ctx, &kafka.DescribeGroupsRequest{GroupIDs: []string{g.groupID}})
+	if err != nil {
+		return nil, fmt.Errorf("describe group: %w", err)
+	}
+	assigned := make(map[string][]int)
+	for _, group := range res.Groups {
+		if group.Error != nil {
+			return nil, fmt.Errorf("describe group: %w", group.Error)
+		}
+		for _, member := range group.Members {
+			if !bytes.Equal(member.MemberMetadata.UserData, g.member) {
+				continue
+			}
+			for _, topic := range member.MemberAssignments.Topics {
+				assigned[topic.Topic] = append(assigned[topic.Topic], topic.Partitions...)
+			}
+		}
+	}
+	offsets := make(map[topicPartition]brokerOffsets)
+	if len(assigned) == 0 {
+		return offsets, nil
+	}
+	committed, err := g.client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{GroupID: g.groupID, Topics: assigned})
+	if err == nil {
+		err = committed.Error
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetch committed offsets: %w", err)
+	}
+	requests := make(map[string][]kafka.OffsetRequest)
+	for topic, partitions := range assigned {
+		for _, partition := range partitions {
+			requests[topic] = append(requests[topic], kafka.LastOffsetOf(partition))
+		}
+	}
+	last, err := g.client.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: requests})
+	if err != nil {
+		return nil, fmt.Errorf("list offsets: %w", err)
+	}
+	for topic, partitions := range last.Topics {
+		for _, p := range partitions {
+			if p.Error != nil {
+				return nil, fmt.Errorf("list offsets %s[%d]: %w", topic, p.Partition, p.Error)
+			}
+			offsets[topicPartition{topic: topic, partition: p.Partition}] = brokerOffsets{committed: -1, highWatermark: p.LastOffset}
+		}
+	}
+	for topic, partitions := range committed.Topics {
+		for _, p := range partitions {
+			key := topicPartition{topic: topic, partition: p.Partition}
+			o, ok := offsets[key]
+			if p.Error != nil || !ok {
+				continue
+			}
+			o.committed = p.CommittedOffset
+			offsets[key] = o
+		}
+	}
+	return offsets, nil
+}
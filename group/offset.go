@@ -0,0 +1,311 @@
+package group
+
+import (
+	"context"
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+type topicPartition struct {
+	topic     string
+	partition int
+}
+
+// offsets tracks every message a consumer fetched until elasticsearch acknowledged it,
+// so that only the highest contiguous acknowledged offset of each partition is committed.
+// A failed message is signaled on failures: the consumer restarts its reader so that the
+// message is consumed again from the committed offset, and the offsets fetched until then
+// are dropped by reset.
+type offsets struct {
+	mux        sync.Mutex
+	partitions map[topicPartition]*partitionOffsets
+	failures   chan struct{}
+}
+
+func newOffsets() *offsets {
+	return &offsets{
+		partitions: make(map[topicPartition]*partitionOffsets),
+		failures:   make(chan struct{}, 1),
+	}
+}
+
+// track registers a fetched message and returns the function to call once the message was handled.
+// A nil error acknowledges the message, a non nil error keeps the partition from committing past it.
+func (o *offsets) track(msg kafka.Message) func(error) {
+	key := topicPartition{topic: msg.Topic, partition: msg.Partition}
+	o.mux.Lock()
+	p, ok := o.partitions[key]
+	if !ok || !p.add(msg.Offset) {
+		// first message of the partition, or the reader was rewound by a rebalance:
+		// acknowledgements of the previous generation must not be committed anymore.
+		p = newPartitionOffsets(msg.Topic, msg.Partition)
+		p.add(msg.Offset)
+		o.partitions[key] = p
+	}
+	o.mux.Unlock()
+
+	var once sync.Once
+	return func(err error) {
+		once.Do(func() {
+			if !p.ack(msg.Offset, err) {
+				return
+			}
+			o.mux.Lock()
+			defer o.mux.Unlock()
+			// not signaled for the messages fetched before a reset or a rewind
+			if o.partitions[key] == p {
+				select {
+				case o.failures <- struct{}{}:
+				default:
+				}
+			}
+		})
+	}
+}
+
+// reset drops the tracked offsets, the acknowledgements of the messages fetched before are
+// not committed anymore.
+func (o *offsets) reset() {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.partitions = make(map[topicPartition]*partitionOffsets)
+	select {
+	case <-o.failures:
+	default:
+	}
+}
+
+// commits returns a message for every partition whose watermark advanced since the last call.
+func (o *offsets) commits() []kafka.Message {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	msgs := make([]kafka.Message, 0)
+	for _, p := range o.partitions {
+		if offset, ok := p.watermark(); ok {
+			msgs = append(msgs, kafka.Message{Topic: p.topic, Partition: p.partition, Offset: offset})
+		}
+	}
+	return msgs
+}
+
+// failed returns the number of messages of a partition that failed, the partition does not
+// commit past the first one until it is consumed again.
+func (o *offsets) failed(key topicPartition) int {
+	o.mux.Lock()
+	p, ok := o.partitions[key]
+	o.mux.Unlock()
+	if !ok {
+		return 0
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return p.failed
+}
+
+// pending returns the number of fetched and not acknowledged messages.
+func (o *offsets) pending() int {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	n := 0
+	for _, p := range o.partitions {
+		p.mux.Lock()
+		for _, offset := range p.pending {
+			if !offset.acked {
+				n++
+			}
+		}
+		p.mux.Unlock()
+	}
+	return n
+}
+
+type pendingOffset struct {
+	offset int64
+	acked  bool
+	failed bool
+}
+
+type partitionOffsets struct {
+	mux       sync.Mutex
+	topic     string
+	partition int
+	last      int64           // last fetched offset
+	pending   []pendingOffset // fetched but not committable offsets, in fetch order
+	acked     int64           // highest contiguous acknowledged offset
+	committed int64           // acked offset returned by the last watermark call
+	failed    int             // pending offsets acknowledged with an error
+}
+
+func newPartitionOffsets(topic string, partition int) *partitionOffsets {
+	return &partitionOffsets{
+		topic:     topic,
+		partition: partition,
+		last:      -1,
+		acked:     -1,
+		committed: -1,
+	}
+}
+
+// add appends a fetched offset, it returns false when offsets are not increasing.
+func (p *partitionOffsets) add(offset int64) bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if offset <= p.last {
+		return false
+	}
+	p.last = offset
+	p.pending = append(p.pending, pendingOffset{offset: offset})
+	return true
+}
+
+// ack acknowledges offset, an error keeps it pending so that the partition is not committed
+// past it: the message is consumed again after a restart or a rebalance. It returns true when
+// the message failed, not because the consumers are stopped.
+func (p *partitionOffsets) ack(offset int64, err error) bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	i := sort.Search(len(p.pending), func(i int) bool { return p.pending[i].offset >= offset })
+	if i == len(p.pending) || p.pending[i].offset != offset {
+		return false
+	}
+	if err != nil {
+		if !p.pending[i].failed {
+			p.pending[i].failed = true
+			p.failed++
+		}
+		if errors.Is(err, context.Canceled) {
+			return false
+		}
+		log.Printf("%s[%d] offset %d not acknowledged, commits stop before it: %s", p.topic, p.partition, offset, err)
+		return true
+	}
+	p.pending[i].acked = true
+	n := 0
+	for n < len(p.pending) && p.pending[n].acked {
+		p.acked = p.pending[n].offset
+		n++
+	}
+	p.pending = p.pending[n:]
+	return false
+}
+
+func (p *partitionOffsets) watermark() (int64, bool) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.acked <= p.committed {
+		return 0, false
+	}
+	p.committed = p.acked
+	return p.acked, true
+}
+
+// partitionExpiry is how long a partition not assigned to the consumers anymore is reported
+// after its last fetch or commit, so that the partitions assigned to another member after a
+// rebalance do not report a stale lag.
+const partitionExpiry = 5 * time.Minute
+
+// partitions tracks the fetched, committed and high watermark offsets of the partitions
+// of all consumers.
+type partitions struct {
+	mux        sync.Mutex
+	partitions map[topicPartition]*PartitionStats
+	updated    map[topicPartition]time.Time
+	owners     map[topicPartition]*offsets // offsets of the consumer that fetched the partition last
+	assigned   map[topicPartition]struct{} // assigned to the consumers according to the brokers
+}
+
+type PartitionStats struct {
+	Topic         string
+	Partition     int
+	Offset        int64 // last fetched offset
+	HighWatermark int64
+	Committed     int64 // next offset to consume committed to the group, -1 before the first commit
+	Lag           int64 // messages after the committed offset
+	Failed        int   // messages that failed, the partition is not committed past the first one
+}
+
+func newPartitions() *partitions {
+	return &partitions{
+		partitions: make(map[topicPartition]*PartitionStats),
+		updated:    make(map[topicPartition]time.Time),
+		owners:     make(map[topicPartition]*offsets),
+		assigned:   make(map[topicPartition]struct{}),
+	}
+}
+
+func (p *partitions) get(topic string, partition int) *PartitionStats {
+	key := topicPartition{topic: topic, partition: partition}
+	stats, ok := p.partitions[key]
+	if !ok {
+		stats = &PartitionStats{Topic: topic, Partition: partition, Committed: -1}
+		p.partitions[key] = stats
+	}
+	p.updated[key] = time.Now()
+	return stats
+}
+
+func (p *partitions) fetched(msg kafka.Message, owner *offsets) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	stats := p.get(msg.Topic, msg.Partition)
+	stats.Offset = msg.Offset
+	if msg.HighWaterMark > stats.HighWatermark {
+		// the messages queued by the reader carry the high watermark of their fetch
+		stats.HighWatermark = msg.HighWaterMark
+	}
+	p.owners[topicPartition{topic: msg.Topic, partition: msg.Partition}] = owner
+}
+
+func (p *partitions) committed(msgs []kafka.Message) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for _, msg := range msgs {
+		p.get(msg.Topic, msg.Partition).Committed = msg.Offset + 1
+	}
+}
+
+// assign replaces the partitions assigned to the consumers, with their offsets read from the
+// brokers.
+func (p *partitions) assign(offsets map[topicPartition]brokerOffsets) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.assigned = make(map[topicPartition]struct{}, len(offsets))
+	for key, o := range offsets {
+		p.assigned[key] = struct{}{}
+		stats := p.get(key.topic, key.partition)
+		stats.HighWatermark = o.highWatermark
+		if o.committed > stats.Committed {
+			stats.Committed = o.committed
+		}
+	}
+}
+
+func (p *partitions) stats() []PartitionStats {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	stats := make([]PartitionStats, 0, len(p.partitions))
+	for key, partition := range p.partitions {
+		if _, ok := p.assigned[key]; !ok && time.Since(p.updated[key]) > partitionExpiry {
+			delete(p.partitions, key)
+			delete(p.updated, key)
+			delete(p.owners, key)
+			continue
+		}
+		s := *partition
+		if owner := p.owners[key]; owner != nil {
+			s.Failed = owner.failed(key)
+		}
+		if s.Committed >= 0 && s.HighWatermark > s.Committed {
+			s.Lag = s.HighWatermark - s.Committed
+		} else if s.Committed < 0 && s.HighWatermark > s.Offset+1 {
+			// nothing committed yet, the messages after the fetched one
+			s.Lag = s.HighWatermark - s.Offset - 1
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}
@@ -0,0 +1,267 @@
+package group
+
+import (
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// step fetches an offset of partition 0 when ack is false, or acknowledges a fetch of it otherwise.
+type step struct {
+	offset int64
+	ack    bool
+	gen    int // fetch of the offset to acknowledge, 1 after a rewind
+	err    error
+}
+
+func fetch(offset int64) step {
+	return step{offset: offset}
+}
+
+func ack(offset int64) step {
+	return step{offset: offset, ack: true}
+}
+
+func ackGen(offset int64, gen int) step {
+	return step{offset: offset, ack: true, gen: gen}
+}
+
+func fail(offset int64) step {
+	return step{offset: offset, ack: true, err: errors.New("rejected")}
+}
+
+func TestOffsets(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   []step
+		commits []int64 // committed offset after the steps, nothing when empty
+		pending int
+		failed  int
+	}{
+		{
+			name:    "nothing acknowledged",
+			steps:   []step{fetch(0), fetch(1)},
+			pending: 2,
+		},
+		{
+			name:    "in order",
+			steps:   []step{fetch(0), fetch(1), ack(0), ack(1)},
+			commits: []int64{1},
+		},
+		{
+			name:    "out of order waits for the gap",
+			steps:   []step{fetch(0), fetch(1), fetch(2), ack(2), ack(1)},
+			pending: 1,
+		},
+		{
+			name:    "out of order once the gap is acknowledged",
+			steps:   []step{fetch(0), fetch(1), fetch(2), ack(2), ack(1), ack(0)},
+			commits: []int64{2},
+		},
+		{
+			name:    "up to the first gap",
+			steps:   []step{fetch(0), fetch(1), fetch(2), fetch(3), ack(3), ack(0), ack(1)},
+			commits: []int64{1},
+			pending: 1,
+		},
+		{
+			name:    "compacted offsets",
+			steps:   []step{fetch(3), fetch(7), ack(7), ack(3)},
+			commits: []int64{7},
+		},
+		{
+			name:    "failed offset stops the commits",
+			steps:   []step{fetch(0), fetch(1), fetch(2), ack(0), fail(1), ack(2)},
+			commits: []int64{0},
+			pending: 1,
+			failed:  1,
+		},
+		{
+			name:    "failed offset acknowledged again",
+			steps:   []step{fetch(0), fail(0), ack(0)},
+			pending: 1,
+			failed:  1,
+		},
+		{
+			name:    "rebalance rewind drops the previous generation",
+			steps:   []step{fetch(0), fetch(1), fetch(2), ack(2), fetch(1), ack(0), ack(1)},
+			pending: 1,
+		},
+		{
+			name:    "rebalance rewind commits the new generation",
+			steps:   []step{fetch(0), fetch(1), fail(1), fetch(1), fetch(2), ackGen(1, 1), ack(2)},
+			commits: []int64{2},
+		},
+		{
+			name:    "rebalance rewind to the same offset",
+			steps:   []step{fetch(5), fetch(5), ack(5)},
+			pending: 1,
+		},
+		{
+			name:    "rebalance rewind to the same offset acknowledged",
+			steps:   []step{fetch(5), fetch(5), ack(5), ackGen(5, 1)},
+			commits: []int64{5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOffsets()
+			acks := make(map[int64][]func(error)) // by offset, of each generation
+			for _, s := range tt.steps {
+				if !s.ack {
+					acks[s.offset] = append(acks[s.offset], o.track(kafka.Message{Topic: "t", Offset: s.offset}))
+					continue
+				}
+				acks[s.offset][s.gen](s.err)
+			}
+			commits := make([]int64, 0)
+			for _, msg := range o.commits() {
+				commits = append(commits, msg.Offset)
+			}
+			if tt.commits == nil {
+				tt.commits = []int64{}
+			}
+			if !reflect.DeepEqual(commits, tt.commits) {
+				t.Errorf("commits = %v, want %v", commits, tt.commits)
+			}
+			if pending := o.pending(); pending != tt.pending {
+				t.Errorf("pending = %d, want %d", pending, tt.pending)
+			}
+			if failed := o.failed(topicPartition{topic: "t"}); failed != tt.failed {
+				t.Errorf("failed = %d, want %d", failed, tt.failed)
+			}
+		})
+	}
+}
+
+func TestOffsetsCommits(t *testing.T) {
+	o := newOffsets()
+	acks := make([]func(error), 0)
+	for partition := 0; partition < 3; partition++ {
+		for offset := int64(0); offset < 3; offset++ {
+			acks = append(acks, o.track(kafka.Message{Topic: "t", Partition: partition, Offset: offset}))
+		}
+	}
+	commits := func() map[int]int64 {
+		committed := make(map[int]int64)
+		for _, msg := range o.commits() {
+			committed[msg.Partition] = msg.Offset
+		}
+		return committed
+	}
+	tests := []struct {
+		name string
+		acks []int // indexes of acks, partition*3 + offset
+		want map[int]int64
+	}{
+		{name: "nothing acknowledged", want: map[int]int64{}},
+		{name: "first offsets", acks: []int{0, 3}, want: map[int]int64{0: 0, 1: 0}},
+		{name: "unchanged watermarks are not committed again", want: map[int]int64{}},
+		{name: "gap", acks: []int{2, 8}, want: map[int]int64{}},
+		{name: "gaps acknowledged", acks: []int{1, 6, 7}, want: map[int]int64{0: 2, 2: 2}},
+		{name: "acknowledged twice", acks: []int{1}, want: map[int]int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, i := range tt.acks {
+				acks[i](nil)
+			}
+			if got := commits(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("commits = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPartitionsFailed(t *testing.T) {
+	p, o := newPartitions(), newOffsets()
+	msg := kafka.Message{Topic: "t", Partition: 1, Offset: 10, HighWaterMark: 20}
+	p.fetched(msg, o)
+	o.track(msg)(errors.New("rejected"))
+	stats := p.stats()
+	if len(stats) != 1 || stats[0].Failed != 1 || stats[0].Lag != 9 {
+		t.Fatalf("stats = %+v, want 1 failed message and a lag of 9", stats)
+	}
+	// consumed again by another consumer after a rebalance
+	other := newOffsets()
+	p.fetched(msg, other)
+	other.track(msg)(nil)
+	if stats = p.stats(); stats[0].Failed != 0 {
+		t.Errorf("failed = %d after the rebalance, want 0", stats[0].Failed)
+	}
+}
+
+func TestPartitionsAssigned(t *testing.T) {
+	p := newPartitions()
+	idle := topicPartition{topic: "t", partition: 0}
+	revoked := topicPartition{topic: "t", partition: 1}
+	p.fetched(kafka.Message{Topic: "t", Partition: 1, Offset: 4, HighWaterMark: 5}, newOffsets())
+	p.assign(map[topicPartition]brokerOffsets{idle: {committed: 10, highWatermark: 25}})
+	p.updated[idle] = time.Now().Add(-2 * partitionExpiry)
+	p.updated[revoked] = time.Now().Add(-2 * partitionExpiry)
+	stats := p.stats()
+	if len(stats) != 1 {
+		t.Fatalf("stats = %+v, want the assigned partition only", stats)
+	}
+	if stats[0].Partition != 0 || stats[0].Committed != 10 || stats[0].Lag != 15 {
+		t.Errorf("stats = %+v, want a lag of 15 after the committed offset 10", stats[0])
+	}
+	// the high watermark of a message queued before the broker answered is older
+	p.fetched(kafka.Message{Topic: "t", Partition: 0, Offset: 10, HighWaterMark: 20}, newOffsets())
+	if stats = p.stats(); stats[0].HighWatermark != 25 {
+		t.Errorf("high watermark = %d, want 25", stats[0].HighWatermark)
+	}
+}
+
+func TestOffsetsFailedInBatch(t *testing.T) {
+	o := newOffsets()
+	acks := make([]func(error), 0)
+	for offset := int64(0); offset < 5; offset++ {
+		acks = append(acks, o.track(kafka.Message{Topic: "t", Offset: offset}))
+	}
+	acks[0](nil)
+	acks[1](nil)
+	acks[3](nil)
+	select {
+	case <-o.failures:
+		t.Fatal("failure signaled before a message failed")
+	default:
+	}
+	acks[2](errors.New("rejected"))
+	acks[4](nil)
+	select {
+	case <-o.failures:
+	default:
+		t.Fatal("failure not signaled")
+	}
+	// the reader is restarted once the offsets before the failed message were committed
+	commits := o.commits()
+	if len(commits) != 1 || commits[0].Offset != 1 {
+		t.Fatalf("commits = %v, want offset 1", commits)
+	}
+	o.reset()
+	if pending := o.pending(); pending != 0 {
+		t.Errorf("pending = %d after the reset, want 0", pending)
+	}
+	// a late failure of a message fetched before the reset does not restart the new reader
+	stale := o.track(kafka.Message{Topic: "u", Offset: 0})
+	o.reset()
+	stale(errors.New("rejected"))
+	select {
+	case <-o.failures:
+		t.Error("failure of a message fetched before the reset signaled")
+	default:
+	}
+	// consumed again from the committed offset
+	for offset := int64(2); offset < 5; offset++ {
+		o.track(kafka.Message{Topic: "t", Offset: offset})(nil)
+	}
+	if commits = o.commits(); len(commits) != 1 || commits[0].Offset != 4 {
+		t.Errorf("commits = %v after the restart, want offset 4", commits)
+	}
+	if o.failed(topicPartition{topic: "t"}) != 0 {
+		t.Error("failed messages after the restart")
+	}
+}
@@ -0,0 +1,250 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/elastic/go-elasticsearch/v7/esutil"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AdaptiveConfig 按 bulk 延迟, took 和拒绝率 AIMD 调整每个索引的 flush 大小和并发,
+// 正常时加性增加, 拥塞时乘性减少
+type AdaptiveConfig struct {
+	MinFlushBytes    int           // Default: 1MB
+	MaxFlushBytes    int           // Default: 20MB
+	FlushBytesStep   int           // 每次增加的 flush 大小 Default: 1MB
+	MinWorkers       int           // Default: 1
+	MaxWorkers       int           // Default: 8
+	TargetLatency    time.Duration // bulk 请求延迟上限, 超过时减少并发 Default: 2s
+	TargetTook       time.Duration // es took 上限, 超过时减少 flush 大小 Default: 1s
+	MaxRejectionRate float64       // 429 文档比例上限, 超过或请求失败时同时减少 Default: 0.01
+	Decrease         float64       // 乘性减少的系数 Default: 0.5
+	Interval         time.Duration // 调整间隔 Default: 10s
+}
+
+func (cfg *AdaptiveConfig) defaults() {
+	if cfg.MinFlushBytes <= 0 {
+		cfg.MinFlushBytes = 1e+6
+	}
+	if cfg.MaxFlushBytes <= 0 {
+		cfg.MaxFlushBytes = 20e+6
+	}
+	if cfg.MaxFlushBytes < cfg.MinFlushBytes {
+		cfg.MaxFlushBytes = cfg.MinFlushBytes
+	}
+	if cfg.FlushBytesStep <= 0 {
+		cfg.FlushBytesStep = 1e+6
+	}
+	if cfg.MinWorkers <= 0 {
+		cfg.MinWorkers = 1
+	}
+	if cfg.MaxWorkers <= 0 {
+		cfg.MaxWorkers = 8
+	}
+	if cfg.MaxWorkers < cfg.MinWorkers {
+		cfg.MaxWorkers = cfg.MinWorkers
+	}
+	if cfg.TargetLatency <= 0 {
+		cfg.TargetLatency = 2 * time.Second
+	}
+	if cfg.TargetTook <= 0 {
+		cfg.TargetTook = time.Second
+	}
+	if cfg.MaxRejectionRate <= 0 {
+		cfg.MaxRejectionRate = 0.01
+	}
+	if cfg.Decrease <= 0 || cfg.Decrease >= 1 {
+		cfg.Decrease = 0.5
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+}
+
+// controller decides the flush size and the number of concurrent bulk requests of an index.
+// The bulk indexer runs MaxWorkers workers and a worker waits for a slot before flushing, so
+// that concurrency changes apply at once, while a new flush size needs a new bulk indexer.
+type controller struct {
+	cfg *AdaptiveConfig
+
+	mux        sync.Mutex
+	cond       *sync.Cond
+	workers    int // concurrent bulk requests
+	flushBytes int
+	inFlight   int
+	window     window // observations since the last adjustment
+	last       window
+}
+
+// window are the observations of the bulk requests of an adjustment interval
+type window struct {
+	requests  int
+	failed    int // requests failed as a whole, such as 429 or timeout
+	responses int
+	items     int
+	rejected  int // items rejected with 429
+	latency   time.Duration
+	took      time.Duration
+}
+
+type AdaptiveStats struct {
+	Index         string
+	Pipeline      string
+	Workers       int
+	FlushBytes    int
+	InFlight      int
+	Latency       time.Duration // mean bulk latency of the last interval
+	Took          time.Duration // mean es took of the last interval
+	RejectionRate float64       // rate of the items rejected with 429 of the last interval
+	Failed        int           // bulk requests failed as a whole of the last interval
+}
+
+func newController(cfg *AdaptiveConfig, workers, flushBytes int) *controller {
+	c := &controller{
+		cfg:        cfg,
+		workers:    clamp(workers, cfg.MinWorkers, cfg.MaxWorkers),
+		flushBytes: clamp(flushBytes, cfg.MinFlushBytes, cfg.MaxFlushBytes),
+	}
+	c.cond = sync.NewCond(&c.mux)
+	return c
+}
+
+type flushKey struct{}
+
+type flush struct {
+	start  time.Time
+	failed bool
+}
+
+// onFlushStart waits for a slot of the concurrent bulk requests.
+func (c *controller) onFlushStart(ctx context.Context) context.Context {
+	c.mux.Lock()
+	for c.inFlight >= c.workers {
+		c.cond.Wait()
+	}
+	c.inFlight++
+	c.mux.Unlock()
+	return context.WithValue(ctx, flushKey{}, &flush{start: time.Now()})
+}
+
+func (c *controller) onFlushEnd(ctx context.Context) {
+	f, _ := ctx.Value(flushKey{}).(*flush)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.inFlight--
+	c.cond.Signal()
+	if f == nil {
+		return
+	}
+	c.window.requests++
+	c.window.latency += time.Since(f.start)
+	if f.failed {
+		c.window.failed++
+	}
+}
+
+// onError marks the bulk request of ctx as failed.
+func (c *controller) onError(ctx context.Context) {
+	if f, ok := ctx.Value(flushKey{}).(*flush); ok {
+		f.failed = true
+	}
+}
+
+// UnmarshalFromReader decodes the bulk responses for the bulk indexer and observes their took
+// and rejected items.
+func (c *controller) UnmarshalFromReader(r io.Reader, blk *esutil.BulkIndexerResponse) error {
+	if err := json.NewDecoder(r).Decode(blk); err != nil {
+		return err
+	}
+	rejected := 0
+	for _, item := range blk.Items {
+		for _, res := range item {
+			if res.Status == http.StatusTooManyRequests || res.Error.Type == "es_rejected_execution_exception" {
+				rejected++
+			}
+		}
+	}
+	c.mux.Lock()
+	c.window.responses++
+	c.window.items += len(blk.Items)
+	c.window.rejected += rejected
+	c.window.took += time.Duration(blk.Took) * time.Millisecond
+	c.mux.Unlock()
+	return nil
+}
+
+// adjust decides the flush size and concurrency from the observations of the interval:
+// rejections decrease both, a high took the flush size, a high latency the concurrency,
+// and they are increased otherwise.
+func (c *controller) adjust() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	w := c.window
+	c.window, c.last = window{}, w
+	if w.requests == 0 {
+		return
+	}
+	decrease := func(n, min int) int {
+		return clamp(int(float64(n)*c.cfg.Decrease), min, n)
+	}
+	switch {
+	case w.failed > 0 || w.rejectionRate() > c.cfg.MaxRejectionRate:
+		c.workers = decrease(c.workers, c.cfg.MinWorkers)
+		c.flushBytes = decrease(c.flushBytes, c.cfg.MinFlushBytes)
+	case w.responses > 0 && w.took/time.Duration(w.responses) > c.cfg.TargetTook:
+		c.flushBytes = decrease(c.flushBytes, c.cfg.MinFlushBytes)
+	case w.latency/time.Duration(w.requests) > c.cfg.TargetLatency:
+		c.workers = decrease(c.workers, c.cfg.MinWorkers)
+	default:
+		c.workers = clamp(c.workers+1, c.cfg.MinWorkers, c.cfg.MaxWorkers)
+		c.flushBytes = clamp(c.flushBytes+c.cfg.FlushBytesStep, c.cfg.MinFlushBytes, c.cfg.MaxFlushBytes)
+	}
+	c.cond.Broadcast()
+}
+
+func (w window) rejectionRate() float64 {
+	if w.items == 0 {
+		return 0
+	}
+	return float64(w.rejected) / float64(w.items)
+}
+
+func (c *controller) decision() (workers, flushBytes int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.workers, c.flushBytes
+}
+
+func (c *controller) stats(index, pipeline string) AdaptiveStats {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	stats := AdaptiveStats{
+		Index:         index,
+		Pipeline:      pipeline,
+		Workers:       c.workers,
+		FlushBytes:    c.flushBytes,
+		InFlight:      c.inFlight,
+		RejectionRate: c.last.rejectionRate(),
+		Failed:        c.last.failed,
+	}
+	if c.last.requests > 0 {
+		stats.Latency = c.last.latency / time.Duration(c.last.requests)
+	}
+	if c.last.responses > 0 {
+		stats.Took = c.last.took / time.Duration(c.last.responses)
+	}
+	return stats
+}
+
+func clamp(n, min, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
@@ -0,0 +1,158 @@
+package indexer
+
+import (
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"time"
+	// the timezones are available without the zoneinfo of the system, such as in scratch images
+	_ "time/tzdata"
+)
+
+// bucket intervals
+const (
+	BucketHourly  = "hourly"
+	BucketDaily   = "daily"
+	BucketWeekly  = "weekly"
+	BucketMonthly = "monthly"
+)
+
+// time fallbacks of the messages without time field
+const (
+	TimeKafka  = "kafka"  // the kafka message timestamp, the ingest time when missing
+	TimeIngest = "ingest" // the ingest time
+)
+
+// out of range policies of the events older than MaxPast or newer than MaxFuture
+const (
+	OutOfRangeClamp    = "clamp"     // the bucket of the range limit
+	OutOfRangeCatchAll = "catch_all" // the CatchAllIndex
+	OutOfRangeReject   = "reject"    // rejected as a document elasticsearch refused
+)
+
+// errTimeOutOfRange is the error type of the rejected out of range documents
+const errTimeOutOfRange = "k2es_time_out_of_range_exception"
+
+// Bucket appends the time bucket of the event to the index name, such as k2es-2024.08.21, so
+// that the day of an index is the day of its events in the timezone instead of the ingest day.
+type Bucket struct {
+	Interval      string         // hourly, daily, weekly, monthly
+	Field         string         // epoch_millis or RFC3339 event time Default: _time
+	Location      *time.Location // Default: UTC
+	Layout        string         // go layout of the bucket start Default: by interval, ISO year and week when weekly
+	Fallback      string         // kafka, ingest Default: kafka
+	MaxPast       time.Duration  // 0 does not limit
+	MaxFuture     time.Duration  // 0 does not limit
+	OutOfRange    string         // clamp, catch_all, reject Default: clamp
+	CatchAllIndex string         // index of the out of range events of catch_all
+}
+
+func (b *Bucket) Validate() error {
+	switch b.Interval {
+	case BucketHourly, BucketDaily, BucketWeekly, BucketMonthly:
+	default:
+		return fmt.Errorf("unknown bucket interval %q", b.Interval)
+	}
+	switch b.Fallback {
+	case "", TimeKafka, TimeIngest:
+	default:
+		return fmt.Errorf("unknown bucket time fallback %q", b.Fallback)
+	}
+	switch b.OutOfRange {
+	case "", OutOfRangeClamp, OutOfRangeReject:
+	case OutOfRangeCatchAll:
+		if sanitize(b.CatchAllIndex) == "" {
+			return fmt.Errorf("bucket catch all index is required")
+		}
+	default:
+		return fmt.Errorf("unknown bucket out of range policy %q", b.OutOfRange)
+	}
+	if b.MaxPast < 0 || b.MaxFuture < 0 {
+		return fmt.Errorf("invalid negative bucket range")
+	}
+	return nil
+}
+
+// index returns the bucketed index of msg, an error when the event is out of range and rejected.
+func (b *Bucket) index(index string, msg kafka.Message, f *messageFields) (string, error) {
+	now := time.Now()
+	t, ok := b.time(msg, f)
+	if !ok {
+		t = now
+		if b.Fallback != TimeIngest && !msg.Time.IsZero() {
+			t = msg.Time
+		}
+	}
+	event := t
+	if oldest := now.Add(-b.MaxPast); b.MaxPast > 0 && t.Before(oldest) {
+		if t, ok = b.outOfRange(oldest); !ok {
+			return sanitize(b.CatchAllIndex), nil
+		}
+	} else if newest := now.Add(b.MaxFuture); b.MaxFuture > 0 && t.After(newest) {
+		if t, ok = b.outOfRange(newest); !ok {
+			return sanitize(b.CatchAllIndex), nil
+		}
+	}
+	if t.IsZero() {
+		return "", fmt.Errorf("event time %s is out of range", event.Format(time.RFC3339))
+	}
+	return sanitize(index + "-" + b.format(t)), nil
+}
+
+// outOfRange returns the clamped time, a zero time to reject or false for the catch all index.
+func (b *Bucket) outOfRange(limit time.Time) (time.Time, bool) {
+	switch b.OutOfRange {
+	case OutOfRangeCatchAll:
+		return time.Time{}, false
+	case OutOfRangeReject:
+		return time.Time{}, true
+	}
+	return limit, true
+}
+
+func (b *Bucket) time(msg kafka.Message, f *messageFields) (time.Time, bool) {
+	field := b.Field
+	if field == "" {
+		field = TimeField
+	}
+	fields, err := f.get()
+	if err != nil {
+		return time.Time{}, false
+	}
+	value, ok := lookup(msg, fields, field)
+	if !ok {
+		return time.Time{}, false
+	}
+	return parseTime(value)
+}
+
+func (b *Bucket) format(t time.Time) string {
+	location := b.Location
+	if location == nil {
+		location = time.UTC
+	}
+	t = t.In(location)
+	year, month, day := t.Date()
+	switch b.Interval {
+	case BucketHourly:
+		t = time.Date(year, month, day, t.Hour(), 0, 0, 0, location)
+		return t.Format(b.layout("2006.01.02.15"))
+	case BucketWeekly:
+		if b.Layout == "" {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%04d.w%02d", year, week)
+		}
+		// the monday of the ISO week
+		t = time.Date(year, month, day-(int(t.Weekday())+6)%7, 0, 0, 0, 0, location)
+		return t.Format(b.Layout)
+	case BucketMonthly:
+		return time.Date(year, month, 1, 0, 0, 0, 0, location).Format(b.layout("2006.01"))
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, location).Format(b.layout("2006.01.02"))
+}
+
+func (b *Bucket) layout(layout string) string {
+	if b.Layout != "" {
+		return b.Layout
+	}
+	return layout
+}
@@ -0,0 +1,237 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/elastic/go-elasticsearch/v7/esutil"
+	"io"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+var errNoResponse = errors.New("flush: no response for the item")
+
+// flushError is the error of the items of a bulk request failed as a whole.
+type flushError struct {
+	status int // status of the response, 0 when the request failed without a response
+	err    error
+}
+
+func (e *flushError) Error() string {
+	return e.err.Error()
+}
+
+func (e *flushError) Unwrap() error {
+	return e.err
+}
+
+// bulk is an esutil.BulkIndexer made of single worker bulk indexers, so that the items of each
+// bulk request are known. esutil only reports a bulk request failed as a whole, such as a 429,
+// a 5xx or a transport error, to OnError; bulk then calls OnFailure of each of its items with
+// the error. Items without a body are only settled by the bulk response.
+type bulk struct {
+	next    uint64
+	workers []*bulkWorker
+}
+
+type bulkWorker struct {
+	indexer esutil.BulkIndexer
+
+	mux      sync.Mutex
+	buffered []*bulkItem // items written to the buffer of the worker since its last flush
+	closed   error       // set when closed before the buffered items were flushed
+}
+
+type bulkItem struct {
+	item      esutil.BulkIndexerItem
+	onSuccess func(context.Context, esutil.BulkIndexerItem, esutil.BulkIndexerResponseItem)
+	onFailure func(context.Context, esutil.BulkIndexerItem, esutil.BulkIndexerResponseItem, error)
+	settled   int32
+}
+
+type bulkFlushKey struct{}
+
+// bulkFlush are the items of a bulk request
+type bulkFlush struct {
+	items  []*bulkItem
+	status int // set by statusTransport
+	err    error
+}
+
+// statusClients are the clients recording the status of the bulk responses, by client, so that
+// the product check of a client is made once.
+var statusClients sync.Map // *elasticsearch.Client -> *elasticsearch.Client
+
+// statusClient returns a client sending the requests with client, the status of the response
+// of a bulk request is recorded in its bulkFlush as esutil only reports it in the error text.
+func statusClient(client *elasticsearch.Client) *elasticsearch.Client {
+	if client == nil {
+		return nil
+	}
+	if c, ok := statusClients.Load(client); ok {
+		return c.(*elasticsearch.Client)
+	}
+	transport := &statusTransport{client: client}
+	c, _ := statusClients.LoadOrStore(client, &elasticsearch.Client{API: esapi.New(transport), Transport: transport})
+	return c.(*elasticsearch.Client)
+}
+
+type statusTransport struct {
+	client *elasticsearch.Client
+}
+
+func (t *statusTransport) Perform(req *http.Request) (*http.Response, error) {
+	res, err := t.client.Perform(req)
+	if f, ok := req.Context().Value(bulkFlushKey{}).(*bulkFlush); ok && err == nil {
+		f.status = res.StatusCode
+	}
+	return res, err
+}
+
+func newBulk(cfg esutil.BulkIndexerConfig) (esutil.BulkIndexer, error) {
+	workers := cfg.NumWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	b := &bulk{}
+	for i := 0; i < workers; i++ {
+		w := &bulkWorker{}
+		c := cfg
+		c.NumWorkers = 1
+		c.Client = statusClient(cfg.Client)
+		c.OnFlushStart = func(ctx context.Context) context.Context {
+			if cfg.OnFlushStart != nil {
+				ctx = cfg.OnFlushStart(ctx)
+			}
+			// called under the lock of the worker, after it buffered the items of the request
+			w.mux.Lock()
+			items := w.buffered
+			w.buffered = nil
+			w.mux.Unlock()
+			return context.WithValue(ctx, bulkFlushKey{}, &bulkFlush{items: items})
+		}
+		c.OnError = func(ctx context.Context, err error) {
+			if f, ok := ctx.Value(bulkFlushKey{}).(*bulkFlush); ok {
+				f.err = err
+			}
+			if cfg.OnError != nil {
+				cfg.OnError(ctx, err)
+			}
+		}
+		c.OnFlushEnd = func(ctx context.Context) {
+			if f, ok := ctx.Value(bulkFlushKey{}).(*bulkFlush); ok {
+				var err error = &flushError{status: f.status, err: f.err}
+				switch {
+				case ctx.Err() != nil:
+					// the flush of Close, until its context is done
+					err = fmt.Errorf("%w: %s", ctx.Err(), f.err)
+				case f.err == nil:
+					err = errNoResponse
+				}
+				for _, item := range f.items {
+					item.fail(ctx, err)
+				}
+			}
+			if cfg.OnFlushEnd != nil {
+				cfg.OnFlushEnd(ctx)
+			}
+		}
+		indexer, err := esutil.NewBulkIndexer(c)
+		if err != nil {
+			return nil, err
+		}
+		w.indexer = indexer
+		b.workers = append(b.workers, w)
+	}
+	return b, nil
+}
+
+// Add adds item to the next worker, OnSuccess or OnFailure is called once.
+func (b *bulk) Add(ctx context.Context, item esutil.BulkIndexerItem) error {
+	w := b.workers[atomic.AddUint64(&b.next, 1)%uint64(len(b.workers))]
+	bi := &bulkItem{item: item, onSuccess: item.OnSuccess, onFailure: item.OnFailure}
+	item.OnSuccess = func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem) {
+		if bi.settle() && bi.onSuccess != nil {
+			bi.onSuccess(ctx, item, res)
+		}
+	}
+	item.OnFailure = func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
+		if bi.settle() && bi.onFailure != nil {
+			bi.onFailure(ctx, item, res, err)
+		}
+	}
+	if item.Body != nil {
+		item.Body = &bulkBody{Reader: item.Body, read: func() { w.buffer(bi) }}
+	}
+	return w.indexer.Add(ctx, item)
+}
+
+// Close closes the workers, the items they could not flush before ctx is done fail.
+func (b *bulk) Close(ctx context.Context) error {
+	var err error
+	for _, w := range b.workers {
+		closeErr := w.indexer.Close(ctx)
+		if closeErr == nil {
+			continue
+		}
+		err = closeErr
+		w.mux.Lock()
+		items := w.buffered
+		w.buffered, w.closed = nil, closeErr
+		w.mux.Unlock()
+		for _, item := range items {
+			item.fail(ctx, closeErr)
+		}
+	}
+	return err
+}
+
+func (b *bulk) Stats() esutil.BulkIndexerStats {
+	stats := esutil.BulkIndexerStats{}
+	for _, w := range b.workers {
+		stats = addStats(stats, w.indexer.Stats())
+	}
+	return stats
+}
+
+// buffer records item as part of the next bulk request of the worker.
+func (w *bulkWorker) buffer(item *bulkItem) {
+	w.mux.Lock()
+	err := w.closed
+	if err == nil {
+		w.buffered = append(w.buffered, item)
+	}
+	w.mux.Unlock()
+	if err != nil {
+		item.fail(context.Background(), err)
+	}
+}
+
+func (item *bulkItem) settle() bool {
+	return atomic.CompareAndSwapInt32(&item.settled, 0, 1)
+}
+
+func (item *bulkItem) fail(ctx context.Context, err error) {
+	if item.settle() && item.onFailure != nil {
+		item.onFailure(ctx, item.item, esutil.BulkIndexerResponseItem{}, err)
+	}
+}
+
+// bulkBody calls read when the worker reads the body to write it into its buffer.
+type bulkBody struct {
+	io.Reader
+	read func()
+}
+
+func (b *bulkBody) Read(p []byte) (int, error) {
+	if b.read != nil {
+		b.read()
+		b.read = nil
+	}
+	return b.Reader.Read(p)
+}
@@ -0,0 +1,74 @@
+package indexer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/elastic/go-elasticsearch/v7/esutil"
+	"log"
+	"strings"
+)
+
+const (
+	// TimestampField is the timestamp every data stream document must have
+	TimestampField = "@timestamp"
+	// TimeField is the epoch_millis event time mapped to TimestampField when missing
+	TimeField = "_time"
+
+	// errMissingTimestamp is the error type of documents without TimestampField nor TimeField
+	errMissingTimestamp = "k2es_missing_timestamp_exception"
+)
+
+// prepareDataStream ensures the document has a TimestampField, copying TimeField when missing.
+// The field is inserted at the beginning of the document without decoding its values.
+func prepareDataStream(value []byte, f *messageFields) ([]byte, error) {
+	fields, err := f.get()
+	if err != nil {
+		return nil, fmt.Errorf("decode document: %w", err)
+	}
+	if _, ok := fields[TimestampField]; ok {
+		return value, nil
+	}
+	t, ok := fields[TimeField]
+	if !ok || len(t) == 0 || t[0] == 'n' {
+		return nil, fmt.Errorf("data stream document requires a %s or %s field", TimestampField, TimeField)
+	}
+	rest := bytes.TrimSpace(value)[1:]
+	body := make([]byte, 0, len(value)+len(TimestampField)+len(t)+4)
+	body = append(body, `{"`+TimestampField+`":`...)
+	body = append(body, t...)
+	if len(bytes.TrimSpace(rest)) > 0 && bytes.TrimSpace(rest)[0] != '}' {
+		body = append(body, ',')
+	}
+	return append(body, rest...), nil
+}
+
+// createDataStream creates the data stream of index, a matching index template with
+// data_stream enabled must exist.
+func (mgmt *Mgmt) createDataStream(index string) {
+	res, err := esapi.IndicesCreateDataStreamRequest{Name: index}.Do(mgmt.ctx, mgmt.es)
+	if err != nil {
+		log.Printf("create data stream %s: %s", index, err)
+		return
+	}
+	defer res.Body.Close()
+	if body := res.String(); res.IsError() && !strings.Contains(body, "resource_already_exists_exception") {
+		log.Printf("create data stream %s: %s", index, body)
+	}
+}
+
+// dataStreamHint explains the common data stream rejections.
+func dataStreamHint(res esutil.BulkIndexerResponseItem) string {
+	reason := res.Error.Reason + " " + res.Error.Cause.Reason
+	switch {
+	case res.Error.Type == errMissingTimestamp:
+		return "the message has no " + TimestampField + " nor " + TimeField
+	case strings.Contains(reason, "op_type of create"):
+		return "data streams only accept the create action"
+	case strings.Contains(reason, "timestamp field"):
+		return "the " + TimestampField + " field is missing or not a date"
+	case res.Error.Type == "index_not_found_exception", strings.Contains(reason, "no matching index template"):
+		return "no index template with data_stream enabled matches the data stream"
+	}
+	return ""
+}
@@ -0,0 +1,77 @@
+package indexer
+
+import (
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"github.com/segmentio/kafka-go"
+	"strconv"
+)
+
+// document id strategies
+const (
+	IDNone   = ""       // elasticsearch generates the id
+	IDField  = "field"  // the value of a json field, such as _uuid
+	IDKey    = "key"    // the kafka message key
+	IDOffset = "offset" // topic-partition-offset
+	IDHash   = "hash"   // xxhash of the values of a set of json fields
+)
+
+// IDStrategy derives a deterministic document id from a message, so that a message consumed
+// again after a rebalance or a crash overwrites, or conflicts with when created, the first copy.
+type IDStrategy struct {
+	Type   string
+	Field  string   // IDField
+	Fields []string // IDHash
+}
+
+func (s *IDStrategy) Validate() error {
+	switch s.Type {
+	case IDNone, IDKey, IDOffset:
+	case IDField:
+		if s.Field == "" {
+			return fmt.Errorf("id field is required")
+		}
+	case IDHash:
+		if len(s.Fields) == 0 {
+			return fmt.Errorf("id hash fields are required")
+		}
+	default:
+		return fmt.Errorf("unknown id type %q", s.Type)
+	}
+	return nil
+}
+
+// id returns the document id of msg, "" lets elasticsearch generate it. ok is false when the
+// strategy can not derive the id, because the key or a field is missing or the message is not
+// json: elasticsearch generates it rather than giving the same id to different documents.
+func (s *IDStrategy) id(msg kafka.Message, f *messageFields) (string, bool) {
+	if s == nil {
+		return "", true
+	}
+	switch s.Type {
+	case IDKey:
+		return string(msg.Key), len(msg.Key) > 0
+	case IDOffset:
+		return msg.Topic + "-" + strconv.Itoa(msg.Partition) + "-" + strconv.FormatInt(msg.Offset, 10), true
+	case IDField, IDHash:
+		fields, err := f.get()
+		if err != nil {
+			return "", false
+		}
+		if s.Type == IDField {
+			return lookup(msg, fields, s.Field)
+		}
+		digest := xxhash.New()
+		for _, field := range s.Fields {
+			value, ok := lookup(msg, fields, field)
+			if !ok {
+				return "", false
+			}
+			_, _ = digest.WriteString(value)
+			// separates the values so that ("ab", "c") and ("a", "bc") differ
+			_, _ = digest.Write([]byte{0})
+		}
+		return strconv.FormatUint(digest.Sum64(), 16), true
+	}
+	return "", true
+}
@@ -0,0 +1,125 @@
+package indexer
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latency sources
+const (
+	LatencyKafka = "kafka" // from the kafka message timestamp
+	LatencyEvent = "event" // from the TimeField of the document
+)
+
+// LatencyBuckets are the default upper bounds in seconds, up to a day for the late events.
+var LatencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600, 21600, 86400}
+
+// Latency is the histogram of the end-to-end latency of each topic, from the kafka message
+// timestamp and from the event time of the document to the elasticsearch acknowledgement.
+type Latency struct {
+	buckets    []float64
+	histograms sync.Map // histogramKey -> *histogram
+}
+
+type histogramKey struct {
+	topic  string
+	source string
+}
+
+type histogram struct {
+	counts []uint64 // by bucket, the last one is +Inf
+	sum    uint64   // microseconds
+}
+
+type LatencyStats struct {
+	Topic   string
+	Source  string
+	Count   uint64
+	Sum     float64            // seconds
+	Buckets map[float64]uint64 // cumulative counts by upper bound
+}
+
+// NewLatency returns the latency histograms, buckets are the upper bounds in seconds
+// Default: LatencyBuckets
+func NewLatency(buckets []float64) *Latency {
+	if len(buckets) == 0 {
+		buckets = LatencyBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &Latency{buckets: buckets}
+}
+
+// observe records the latency of a document acknowledged by elasticsearch.
+func (l *Latency) observe(doc *document) {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	if !doc.msg.Time.IsZero() {
+		l.histogram(doc.msg.Topic, LatencyKafka).observe(l.buckets, now.Sub(doc.msg.Time))
+	}
+	if !doc.eventTime.IsZero() {
+		l.histogram(doc.msg.Topic, LatencyEvent).observe(l.buckets, now.Sub(doc.eventTime))
+	}
+}
+
+func (l *Latency) histogram(topic, source string) *histogram {
+	key := histogramKey{topic: topic, source: source}
+	if h, ok := l.histograms.Load(key); ok {
+		return h.(*histogram)
+	}
+	h, _ := l.histograms.LoadOrStore(key, &histogram{counts: make([]uint64, len(l.buckets)+1)})
+	return h.(*histogram)
+}
+
+func (h *histogram) observe(buckets []float64, d time.Duration) {
+	if d < 0 {
+		// clock skew or an event time in the future
+		d = 0
+	}
+	i := sort.SearchFloat64s(buckets, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, uint64(d.Microseconds()))
+}
+
+// eventTime returns the TimeField of a json document.
+func eventTime(f *messageFields) (time.Time, bool) {
+	if !bytes.Contains(f.value, []byte(`"`+TimeField+`"`)) {
+		return time.Time{}, false
+	}
+	fields, err := f.get()
+	if err != nil {
+		return time.Time{}, false
+	}
+	value, ok := scalar(fields[TimeField])
+	if !ok {
+		return time.Time{}, false
+	}
+	return parseTime(value)
+}
+
+func (l *Latency) Stats() []LatencyStats {
+	stats := make([]LatencyStats, 0)
+	l.histograms.Range(func(key, value interface{}) bool {
+		k, h := key.(histogramKey), value.(*histogram)
+		s := LatencyStats{
+			Topic:   k.topic,
+			Source:  k.source,
+			Sum:     float64(atomic.LoadUint64(&h.sum)) / 1e6,
+			Buckets: make(map[float64]uint64, len(l.buckets)),
+		}
+		for i := range h.counts {
+			s.Count += atomic.LoadUint64(&h.counts[i])
+			if i < len(l.buckets) {
+				s.Buckets[l.buckets[i]] = s.Count
+			}
+		}
+		stats = append(stats, s)
+		return true
+	})
+	return stats
+}
@@ -0,0 +1,92 @@
+package indexer
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/segmentio/kafka-go"
+)
+
+// Metadata injects the kafka metadata of a message into its document, so that a document can be
+// traced back to the message it was indexed from.
+type Metadata struct {
+	Field    string   // field of the metadata object, "" disables the injection
+	Headers  []string // headers copied into the metadata
+	ClientID string   // client id of the consumer
+}
+
+type metadata struct {
+	Topic     string            `json:"topic"`
+	Partition int               `json:"partition"`
+	Offset    int64             `json:"offset"`
+	Timestamp string            `json:"timestamp,omitempty"`
+	Key       string            `json:"key,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	ClientID  string            `json:"client_id,omitempty"`
+}
+
+func (m *Metadata) enabled() bool {
+	return m != nil && m.Field != ""
+}
+
+// inject returns body with the metadata of msg under Field. The object is inserted at the
+// beginning of the document without decoding it unless the document already has the field,
+// a body which is not a json object is returned as it is.
+func (m *Metadata) inject(msg kafka.Message, body []byte) []byte {
+	if !m.enabled() {
+		return body
+	}
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return body
+	}
+	meta := metadata{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       string(msg.Key),
+		ClientID:  m.ClientID,
+	}
+	if !msg.Time.IsZero() {
+		meta.Timestamp = msg.Time.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	}
+	for _, name := range m.Headers {
+		for _, header := range msg.Headers {
+			if header.Key != name {
+				continue
+			}
+			if meta.Headers == nil {
+				meta.Headers = make(map[string]string, len(m.Headers))
+			}
+			meta.Headers[name] = string(header.Value)
+		}
+	}
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return body
+	}
+	key, _ := json.Marshal(m.Field)
+
+	if bytes.Contains(trimmed, key) {
+		// the field may already exist, replaced to avoid a duplicate key
+		var fields map[string]json.RawMessage
+		if err = json.Unmarshal(trimmed, &fields); err != nil {
+			return body
+		}
+		fields[m.Field] = value
+		if replaced, err := json.Marshal(fields); err == nil {
+			return replaced
+		}
+		return body
+	}
+
+	rest := bytes.TrimSpace(trimmed[1:])
+	injected := make([]byte, 0, len(trimmed)+len(key)+len(value)+3)
+	injected = append(injected, '{')
+	injected = append(injected, key...)
+	injected = append(injected, ':')
+	injected = append(injected, value...)
+	if len(rest) > 0 && rest[0] != '}' {
+		injected = append(injected, ',')
+	}
+	return append(injected, rest...)
+}
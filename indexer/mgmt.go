@@ -1,29 +1,62 @@
 package indexer
 
 import (
-	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/elastic/go-elasticsearch/v7/esutil"
 	"github.com/segmentio/kafka-go"
+	"github.com/ydgo/k2es/breaker"
+	"github.com/ydgo/k2es/charset"
+	"github.com/ydgo/k2es/codec"
 	"github.com/ydgo/k2es/data"
+	"github.com/ydgo/k2es/deadletter"
+	"github.com/ydgo/k2es/processor"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Mgmt struct {
 	ctx     context.Context
+	stop    context.CancelFunc // stops clean and adapt
+	loops   sync.WaitGroup
 	cfg     Config
 	es      *elasticsearch.Client
-	indexer *sync.Map
+	indexer *sync.Map // indexerKey -> *blukIndexer
+	writer  *writer
+
+	routes       sync.Map // topic -> *Route
+	defaultRoute *Route
 
 	// for sync goroutine
 	mux             sync.Mutex
-	idleBlukIndexer map[string]struct{} // 空闲 indexer
+	idleBlukIndexer map[indexerKey]struct{} // 空闲 indexer
+	retired         map[indexerKey]*retired // 被清除的 indexer, 重新创建时继续累计 stats
+}
+
+// indexerKey identifies a bulk indexer: the pipeline is a parameter of its bulk requests, so
+// the routes writing an index through different pipelines have their own indexers.
+type indexerKey struct {
+	index    string
+	pipeline string
 }
 
+// retired is an indexer closed by clean, its stats are the base of the next indexer of the
+// index so that the counters are monotonic.
+type retired struct {
+	indexer *blukIndexer // closing
+	stats   esutil.BulkIndexerStats
+	at      time.Time
+}
+
+var errIndexerClosed = errors.New("indexer closed")
+
+// retiredRetention is how long the stats of a closed indexer are kept for its index
+const retiredRetention = 24 * time.Hour
+
 func NewIndexerMgmt(ctx context.Context, cfg Config) *Mgmt {
 	if cfg.Workers <= 0 {
 		cfg.Workers = 1
@@ -44,130 +77,399 @@ func NewIndexerMgmt(ctx context.Context, cfg Config) *Mgmt {
 	if cfg.IdleInterval <= 0 {
 		cfg.IdleInterval = 3 * time.Minute
 	}
+	if cfg.Index == nil {
+		cfg.Index, _ = ParseTemplate(data.TestIndex, data.TestIndex)
+	}
+	if cfg.Adaptive != nil {
+		adaptive := *cfg.Adaptive
+		adaptive.defaults()
+		cfg.Adaptive = &adaptive
+	}
 	mgmt := &Mgmt{
 		ctx:             ctx,
 		cfg:             cfg,
 		es:              cfg.Client,
 		indexer:         &sync.Map{},
-		idleBlukIndexer: make(map[string]struct{}),
+		idleBlukIndexer: make(map[indexerKey]struct{}),
+		retired:         make(map[indexerKey]*retired),
+		defaultRoute: &Route{
+			Index:      cfg.Index,
+			DataStream: cfg.DataStream,
+			ID:         cfg.ID,
+			Metadata:   cfg.Metadata,
+			Bucket:     cfg.Bucket,
+			Charset:    cfg.Charset,
+			Codec:      cfg.Codec,
+			Processors: cfg.Processors,
+		},
+	}
+	for _, route := range append([]*Route{mgmt.defaultRoute}, cfg.Routes...) {
+		if route.Action == "" {
+			route.Action = "index"
+			if route.DataStream {
+				route.Action = "create"
+			}
+		}
+	}
+	mgmt.writer = &writer{
+		add: func(ctx context.Context, doc *document, item esutil.BulkIndexerItem) error {
+			for {
+				// an indexer closed by clean is removed first, the next one is a new indexer
+				err := mgmt.getIndexer(doc.index, doc.route).Add(ctx, item)
+				if !errors.Is(err, errIndexerClosed) {
+					return err
+				}
+			}
+		},
+		deadLetter: cfg.DeadLetter,
+		retry:      newRetrier(cfg.Retry),
+		spool:      cfg.Spool,
+		breaker:    cfg.Breaker,
+		latency:    cfg.Latency,
+	}
+	loops, stop := context.WithCancel(ctx)
+	mgmt.stop = stop
+	mgmt.loops.Add(1)
+	go mgmt.clean(loops)
+	if cfg.Adaptive != nil {
+		mgmt.loops.Add(1)
+		go mgmt.adapt(loops)
 	}
-	go mgmt.clean()
 	return mgmt
 }
 
 type Config struct {
 	Client        *elasticsearch.Client
-	Workers       int           // Default: 1
-	FlushInterval time.Duration // Default: 15s
-	Timeout       time.Duration // Default: 9s
-	FlushBytes    int           // 5e6 = 5MB
-	MaxIdleCount  int           // 最大空闲次数 Default: 3
-	IdleInterval  time.Duration // 清除空闲 indexer 的间隔时间 Default: 3 minute
+	Index         *Template          // 根据消息生成索引名 Default: k2es
+	Routes        []*Route           // 按 topic 路由, 未匹配的 topic 写入 Index
+	DataStream    bool               // Index 为 data stream
+	ID            *IDStrategy        // 文档 id 生成方式 Default: es 生成
+	Metadata      *Metadata          // 写入文档的 kafka 元数据, 为 nil 时不写入
+	Bucket        *Bucket            // 按事件时间分桶的索引后缀, 为 nil 时不分桶
+	Charset       *charset.Converter // 未匹配路由的 topic 的字符集 Default: utf-8
+	Codec         *codec.Decoder     // 未匹配路由的 topic 的消息格式 Default: json
+	Processors    *processor.Chain   // 未匹配路由的 topic 的处理器
+	Workers       int                // Default: 1
+	FlushInterval time.Duration      // Default: 15s
+	Timeout       time.Duration      // Default: 9s
+	FlushBytes    int                // 5e6 = 5MB
+	MaxIdleCount  int                // 最大空闲次数 Default: 3
+	IdleInterval  time.Duration      // 清除空闲 indexer 的间隔时间 Default: 3 minute
+	DeadLetter    *deadletter.Writer // 被 es 拒绝的文档写入死信 topic, 为 nil 时丢弃
+	Retry         RetryConfig
+	Spool         *Spool           // es 不可用时写入磁盘, 为 nil 时不启用
+	Adaptive      *AdaptiveConfig  // 自适应调整每个索引的 FlushBytes 和 Workers, 为 nil 时不调整
+	Breaker       *breaker.Breaker // 被集群 block 拒绝的文档在熔断恢复后重新写入, 为 nil 时按普通错误处理
+	Latency       *Latency         // es 确认文档的端到端延迟, 为 nil 时不统计
 }
 
-func (mgmt *Mgmt) Handle(ctx context.Context, msg kafka.Message) error {
-	indexer := mgmt.GetIndex(data.TestIndex)
-	item := esutil.BulkIndexerItem{
-		Index:     data.TestIndex,
-		Action:    "index",
-		Body:      bytes.NewReader(msg.Value),
-		OnFailure: mgmt.onFail,
-	}
-	return indexer.Add(ctx, item)
+func (mgmt *Mgmt) Handle(ctx context.Context, msg kafka.Message, ack func(error)) error {
+	route := mgmt.Route(msg.Topic)
+	fields := newMessageFields(msg.Value)
+	return mgmt.writer.write(ctx, route, route.Index.execute(msg, fields), msg, fields, ack)
 }
 
-func (mgmt *Mgmt) onFail(_ context.Context, _ esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
-	if err != nil {
-		log.Println("indexed: ", err)
-	} else if res.Error.Type != "" {
-		log.Printf("indexed %s:%s", res.Error.Type, res.Error.Reason)
-	}
+func (mgmt *Mgmt) GetIndex(index string) esutil.BulkIndexer {
+	return mgmt.getIndexer(index, mgmt.defaultRoute)
 }
 
-func (mgmt *Mgmt) GetIndex(index string) esutil.BulkIndexer {
-	value, ok := mgmt.indexer.Load(index)
+func (mgmt *Mgmt) getIndexer(index string, route *Route) esutil.BulkIndexer {
+	value, ok := mgmt.indexer.Load(indexerKey{index: index, pipeline: route.Pipeline})
 	if ok {
-		indexer := value.(*blukIndexer)
-		return indexer.indexer
+		return value.(*blukIndexer)
 	}
-	return mgmt.addIndexer(index)
+	return mgmt.addIndexer(index, route)
 
 }
 
-// clean all idle indexer
-func (mgmt *Mgmt) clean() {
+// clean all idle indexer until ctx is done, an indexer being closed is closed with the
+// context of the mgmt.
+func (mgmt *Mgmt) clean(ctx context.Context) {
+	defer mgmt.loops.Done()
 	ticker := time.NewTicker(mgmt.cfg.IdleInterval)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
 			mgmt.indexer.Range(func(k, v interface{}) bool {
-				index := k.(string)
+				key := k.(indexerKey)
 				bi, _ := v.(*blukIndexer)
 				if bi.idleCount >= mgmt.cfg.MaxIdleCount {
-					mgmt.indexer.Delete(index)
-					_ = bi.indexer.Close(mgmt.ctx)
-					mgmt.idleBlukIndexer[index] = struct{}{}
+					mgmt.mux.Lock()
+					mgmt.retired[key] = &retired{indexer: bi}
+					mgmt.indexer.Delete(key)
+					mgmt.mux.Unlock()
+					_ = bi.Close(mgmt.ctx)
+					mgmt.mux.Lock()
+					if r := mgmt.retired[key]; r != nil && r.indexer == bi {
+						r.indexer, r.stats, r.at = nil, bi.Stats(), time.Now()
+					}
+					mgmt.idleBlukIndexer[key] = struct{}{}
+					mgmt.mux.Unlock()
 				} else {
-					delete(mgmt.idleBlukIndexer, index)
-					numAdded := bi.indexer.Stats().NumAdded
+					delete(mgmt.idleBlukIndexer, key)
+					numAdded := bi.Stats().NumAdded
 					if bi.numAdded >= numAdded {
 						bi.idleCount++
 					} else {
 						bi.numAdded = numAdded
 						bi.idleCount = 0
 					}
-					log.Printf("%s indexer num_added: %d idle_count: %d\n", index, bi.numAdded, bi.idleCount)
+					log.Printf("%s indexer num_added: %d idle_count: %d\n", key.index, bi.numAdded, bi.idleCount)
 				}
 				return true
 			})
-		case <-mgmt.ctx.Done():
+			mgmt.mux.Lock()
+			for key, r := range mgmt.retired {
+				if r.indexer == nil && time.Since(r.at) > retiredRetention {
+					delete(mgmt.retired, key)
+				}
+			}
+			mgmt.mux.Unlock()
+		case <-ctx.Done():
 			return
 		}
 	}
 
 }
 
+// adapt adjusts the flush size and concurrency of the indexers every interval, an indexer
+// is replaced when its flush size is off the decision by a quarter, until ctx is done.
+func (mgmt *Mgmt) adapt(ctx context.Context) {
+	defer mgmt.loops.Done()
+	ticker := time.NewTicker(mgmt.cfg.Adaptive.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			mgmt.indexer.Range(func(k, v interface{}) bool {
+				bi := v.(*blukIndexer)
+				bi.controller.adjust()
+				_, flushBytes := bi.controller.decision()
+				bi.mux.RLock()
+				current := bi.flushBytes
+				bi.mux.RUnlock()
+				if diff := flushBytes - current; diff*4 >= current || -diff*4 >= current {
+					indexer, _ := mgmt.newBulkIndexer(bi.index, bi.route, bi.controller)
+					bi.replace(indexer, flushBytes)
+				}
+				return true
+			})
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// blukIndexer is the bulk indexer of an index, its esutil.BulkIndexer is replaced to change
+// the flush size while the replaced ones flush their pending documents.
 type blukIndexer struct {
-	numAdded  uint64
-	idleCount int
-	indexer   esutil.BulkIndexer
+	numAdded   uint64
+	idleCount  int
+	index      string
+	route      *Route
+	controller *controller  // nil when not adaptive
+	previous   *blukIndexer // closing indexer of the index when it was created
+
+	mux        sync.RWMutex
+	done       bool // closed, no document is added anymore
+	indexer    esutil.BulkIndexer
+	flushBytes int
+	replaced   map[esutil.BulkIndexer]struct{} // closing
+	closed     esutil.BulkIndexerStats         // stats of the closed replaced indexers
+	closing    sync.WaitGroup
+}
+
+// Add adds item to the indexer, it returns errIndexerClosed once the indexer is closed.
+func (bi *blukIndexer) Add(ctx context.Context, item esutil.BulkIndexerItem) error {
+	bi.mux.RLock()
+	defer bi.mux.RUnlock()
+	if bi.done {
+		return errIndexerClosed
+	}
+	return bi.indexer.Add(ctx, item)
+}
+
+// Close closes the indexer and waits for the replaced ones, it is closed once.
+func (bi *blukIndexer) Close(ctx context.Context) error {
+	bi.mux.Lock()
+	if bi.done {
+		bi.mux.Unlock()
+		return nil
+	}
+	bi.done = true
+	err := bi.indexer.Close(ctx)
+	bi.mux.Unlock()
+	closed := make(chan struct{})
+	go func() {
+		bi.closing.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return err
+}
+
+func (bi *blukIndexer) Stats() esutil.BulkIndexerStats {
+	bi.mux.RLock()
+	defer bi.mux.RUnlock()
+	stats := addStats(bi.closed, bi.indexer.Stats())
+	for indexer := range bi.replaced {
+		stats = addStats(stats, indexer.Stats())
+	}
+	if bi.previous != nil {
+		stats = addStats(stats, bi.previous.Stats())
+	}
+	return stats
+}
+
+// replace swaps the bulk indexer and closes the previous one in the background.
+func (bi *blukIndexer) replace(indexer esutil.BulkIndexer, flushBytes int) {
+	bi.mux.Lock()
+	if bi.done {
+		bi.mux.Unlock()
+		_ = indexer.Close(context.Background())
+		return
+	}
+	previous := bi.indexer
+	bi.indexer, bi.flushBytes = indexer, flushBytes
+	bi.replaced[previous] = struct{}{}
+	bi.mux.Unlock()
+	log.Printf("%s indexer flush bytes: %d", bi.index, flushBytes)
+	bi.closing.Add(1)
+	go func() {
+		defer bi.closing.Done()
+		_ = previous.Close(context.Background())
+		bi.mux.Lock()
+		delete(bi.replaced, previous)
+		bi.closed = addStats(bi.closed, previous.Stats())
+		bi.mux.Unlock()
+	}()
+}
+
+func addStats(a, b esutil.BulkIndexerStats) esutil.BulkIndexerStats {
+	return esutil.BulkIndexerStats{
+		NumAdded:    a.NumAdded + b.NumAdded,
+		NumFlushed:  a.NumFlushed + b.NumFlushed,
+		NumFailed:   a.NumFailed + b.NumFailed,
+		NumIndexed:  a.NumIndexed + b.NumIndexed,
+		NumCreated:  a.NumCreated + b.NumCreated,
+		NumUpdated:  a.NumUpdated + b.NumUpdated,
+		NumDeleted:  a.NumDeleted + b.NumDeleted,
+		NumRequests: a.NumRequests + b.NumRequests,
+	}
 }
 
-func (mgmt *Mgmt) newBulkIndexer(index string) *blukIndexer {
-	indexer, _ := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
-		NumWorkers: mgmt.cfg.Workers,
+// newBulkIndexer returns the bulk indexer of index and its flush bytes, sized by the
+// controller when it is not nil.
+func (mgmt *Mgmt) newBulkIndexer(index string, route *Route, c *controller) (esutil.BulkIndexer, int) {
+	workers, flushBytes, flushInterval := mgmt.sizes(route)
+	cfg := esutil.BulkIndexerConfig{
+		NumWorkers: workers,
 		Client:     mgmt.es,
 		Index:      index,
-		FlushBytes: mgmt.cfg.FlushBytes,
+		Pipeline:   route.Pipeline,
+		FlushBytes: flushBytes,
 		OnError: func(ctx context.Context, err error) {
 			if !errors.Is(err, context.Canceled) {
 				log.Printf("indexer: %s", err)
 			}
 		},
-		FlushInterval: mgmt.cfg.FlushInterval,
+		FlushInterval: flushInterval,
 		Timeout:       mgmt.cfg.Timeout,
-	})
-	return &blukIndexer{
-		indexer: indexer,
 	}
+	if c != nil {
+		// the controller limits the concurrent flushes of the workers
+		_, cfg.FlushBytes = c.decision()
+		cfg.NumWorkers = mgmt.cfg.Adaptive.MaxWorkers
+		cfg.Decoder = c
+		cfg.OnFlushStart = c.onFlushStart
+		cfg.OnFlushEnd = c.onFlushEnd
+		onError := cfg.OnError
+		cfg.OnError = func(ctx context.Context, err error) {
+			c.onError(ctx)
+			onError(ctx, err)
+		}
+	}
+	indexer, _ := newBulk(cfg)
+	return indexer, cfg.FlushBytes
+}
 
+// sizes returns the bulk settings of route, the global ones when it does not set them.
+func (mgmt *Mgmt) sizes(route *Route) (workers, flushBytes int, flushInterval time.Duration) {
+	workers, flushBytes, flushInterval = mgmt.cfg.Workers, mgmt.cfg.FlushBytes, mgmt.cfg.FlushInterval
+	if route.Workers > 0 {
+		workers = route.Workers
+	}
+	if route.FlushBytes > 0 {
+		flushBytes = route.FlushBytes
+	}
+	if route.FlushInterval > 0 {
+		flushInterval = route.FlushInterval
+	}
+	return
 }
 
-func (mgmt *Mgmt) addIndexer(index string) esutil.BulkIndexer {
-	indexer := mgmt.newBulkIndexer(index)
-	mgmt.indexer.Store(index, indexer)
-	return indexer.indexer
+func (mgmt *Mgmt) addIndexer(index string, route *Route) esutil.BulkIndexer {
+	if route.DataStream {
+		mgmt.createDataStream(index)
+	}
+	bi := &blukIndexer{
+		index:    index,
+		route:    route,
+		replaced: make(map[esutil.BulkIndexer]struct{}),
+	}
+	if mgmt.cfg.Adaptive != nil {
+		workers, flushBytes, _ := mgmt.sizes(route)
+		bi.controller = newController(mgmt.cfg.Adaptive, workers, flushBytes)
+	}
+	bi.indexer, bi.flushBytes = mgmt.newBulkIndexer(index, route, bi.controller)
+	key := indexerKey{index: index, pipeline: route.Pipeline}
+	mgmt.mux.Lock()
+	r := mgmt.retired[key]
+	if r != nil {
+		bi.closed, bi.previous = r.stats, r.indexer
+	}
+	value, loaded := mgmt.indexer.LoadOrStore(key, bi)
+	if !loaded {
+		delete(mgmt.retired, key)
+	}
+	mgmt.mux.Unlock()
+	if loaded {
+		// created concurrently by another consumer
+		_ = bi.indexer.Close(context.Background())
+	}
+	return value.(*blukIndexer)
 
 }
 
-// Close all indexer
-func (mgmt *Mgmt) Close() {
+// Close all indexer, pending documents are flushed until ctx is done. clean and adapt are
+// stopped first, so that no indexer is closed or replaced meanwhile.
+func (mgmt *Mgmt) Close(ctx context.Context) error {
+	mgmt.stop()
+	stopped := make(chan struct{})
+	go func() {
+		mgmt.loops.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	var err error
 	mgmt.indexer.Range(func(key, value interface{}) bool {
-		_ = value.(*blukIndexer).indexer.Close(context.Background())
+		// removed first, so that the documents added meanwhile go to a new indexer
 		mgmt.indexer.Delete(key)
+		if closeErr := value.(*blukIndexer).Close(ctx); closeErr != nil {
+			err = fmt.Errorf("close %s: %w", key.(indexerKey).index, closeErr)
+		}
 		return true
 	})
+	return err
 }
 
 type Stats struct {
@@ -175,28 +477,87 @@ type Stats struct {
 	NumFlushed  uint64
 	NumFailed   uint64
 	NumIndexed  uint64
+	NumCreated  uint64
 	NumRequests uint64
 }
 
+type IndexStats struct {
+	Index    string
+	Pipeline string
+	Stats
+}
+
+// Stats returns the sum of the stats of the open indexers.
 func (mgmt *Mgmt) Stats() Stats {
 	stats := Stats{}
+	for _, index := range mgmt.IndexStats() {
+		stats.NumAdded += index.NumAdded
+		stats.NumFlushed += index.NumFlushed
+		stats.NumFailed += index.NumFailed
+		stats.NumIndexed += index.NumIndexed
+		stats.NumCreated += index.NumCreated
+		stats.NumRequests += index.NumRequests
+	}
+	return stats
+}
+
+// IndexStats returns the stats of each open indexer, including the stats of the previous
+// indexers of its index and pipeline.
+func (mgmt *Mgmt) IndexStats() []IndexStats {
+	stats := make([]IndexStats, 0)
 	mgmt.indexer.Range(func(key interface{}, value interface{}) bool {
-		stat := value.(*blukIndexer).indexer.Stats()
-		stats.NumAdded += stat.NumAdded
-		stats.NumFlushed += stat.NumFlushed
-		stats.NumFailed += stat.NumFailed
-		stats.NumIndexed += stat.NumIndexed
-		stats.NumRequests += stat.NumRequests
+		stat, k := value.(*blukIndexer).Stats(), key.(indexerKey)
+		stats = append(stats, IndexStats{
+			Index:    k.index,
+			Pipeline: k.pipeline,
+			Stats: Stats{
+				NumAdded:    stat.NumAdded,
+				NumFlushed:  stat.NumFlushed,
+				NumFailed:   stat.NumFailed,
+				NumIndexed:  stat.NumIndexed,
+				NumCreated:  stat.NumCreated,
+				NumRequests: stat.NumRequests,
+			},
+		})
 		return true
 	})
 	return stats
 }
 
+// IDFallbacks returns by topic the number of documents whose id is generated by elasticsearch
+// because the id strategy could not derive it.
+func (mgmt *Mgmt) IDFallbacks() map[string]uint64 {
+	fallbacks := make(map[string]uint64)
+	mgmt.writer.idFallbacks.Range(func(key, value interface{}) bool {
+		fallbacks[key.(string)] = atomic.LoadUint64(value.(*uint64))
+		return true
+	})
+	return fallbacks
+}
+
 func (mgmt *Mgmt) Indices() []string {
 	indices := make([]string, 0)
+	seen := make(map[string]struct{})
 	mgmt.indexer.Range(func(key interface{}, value interface{}) bool {
-		indices = append(indices, key.(string))
+		index := key.(indexerKey).index
+		if _, ok := seen[index]; !ok {
+			seen[index] = struct{}{}
+			indices = append(indices, index)
+		}
 		return true
 	})
 	return indices
 }
+
+// AdaptiveStats returns the current decisions of the adaptive indexers.
+func (mgmt *Mgmt) AdaptiveStats() []AdaptiveStats {
+	stats := make([]AdaptiveStats, 0)
+	mgmt.indexer.Range(func(key interface{}, value interface{}) bool {
+		if c := value.(*blukIndexer).controller; c != nil {
+			k := key.(indexerKey)
+			stats = append(stats, c.stats(k.index, k.pipeline))
+		}
+		return true
+	})
+	return stats
+}
@@ -0,0 +1,148 @@
+package indexer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/segmentio/kafka-go"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bulkStub answers the bulk requests like elasticsearch, the status of each item is returned
+// by item, 201 when nil. requests counts the bulk requests, sources the indexed documents.
+type bulkStub struct {
+	mux      sync.Mutex
+	status   int                  // status of the whole request, 200 when 0
+	request  func(body []byte) int // status of the whole request by body, when not nil
+	item     func(source string) int
+	requests int
+	sources  []string
+}
+
+func (s *bulkStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+		fmt.Fprint(w, `{"version":{"number":"7.17.10"}}`)
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.requests++
+	body, _ := io.ReadAll(r.Body)
+	status := s.status
+	if s.request != nil {
+		status = s.request(body)
+	}
+	if status != 0 && status != http.StatusOK {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"error":{"type":"stub_exception","reason":"status %d"},"status":%d}`, status, status)
+		return
+	}
+	items := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		var meta map[string]json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &meta); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		scanner.Scan()
+		status := http.StatusCreated
+		if s.item != nil {
+			status = s.item(scanner.Text())
+		}
+		for action := range meta {
+			if status < 300 {
+				s.sources = append(s.sources, scanner.Text())
+				items = append(items, fmt.Sprintf(`{%q:{"_index":"k2es","_id":"%d","status":%d}}`, action, len(items), status))
+			} else {
+				items = append(items, fmt.Sprintf(`{%q:{"_index":"k2es","status":%d,"error":{"type":"stub_exception","reason":"status %d"}}}`, action, status, status))
+			}
+		}
+	}
+	fmt.Fprintf(w, `{"took":1,"errors":true,"items":[%s]}`, strings.Join(items, ","))
+}
+
+func newClient(t *testing.T, handler http.Handler) *elasticsearch.Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	es, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}, DisableRetry: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return es
+}
+
+// acks collects the acknowledgements of the messages.
+type acks struct {
+	mux  sync.Mutex
+	errs []error
+}
+
+func (a *acks) ack(err error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.errs = append(a.errs, err)
+}
+
+// wait waits for n acknowledgements and returns them.
+func (a *acks) wait(t *testing.T, n int) []error {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.mux.Lock()
+		errs := append([]error(nil), a.errs...)
+		a.mux.Unlock()
+		if len(errs) >= n {
+			return errs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d acknowledgements, want %d", len(errs), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMgmtCloseTwice(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mgmt := NewIndexerMgmt(ctx, Config{Client: newClient(t, &bulkStub{}), IdleInterval: time.Millisecond, Adaptive: &AdaptiveConfig{}})
+	var a acks
+	for i := 0; i < 3; i++ {
+		if err := mgmt.Handle(ctx, kafka.Message{Topic: "logs", Value: []byte(`{"a":1}`)}, a.ack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var closed []*blukIndexer
+	mgmt.indexer.Range(func(_, v interface{}) bool {
+		closed = append(closed, v.(*blukIndexer))
+		return true
+	})
+	if err := mgmt.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range a.wait(t, 3) {
+		if err != nil {
+			t.Errorf("ack: %s", err)
+		}
+	}
+	for _, bi := range closed {
+		if err := bi.Close(ctx); err != nil {
+			t.Errorf("second close: %s", err)
+		}
+	}
+	if err := mgmt.Close(ctx); err != nil {
+		t.Errorf("second mgmt close: %s", err)
+	}
+}
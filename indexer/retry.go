@@ -0,0 +1,100 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"github.com/elastic/go-elasticsearch/v7/esutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryConfig 单个文档的重试策略, 只重试 429, 5xx 以及可重试的错误类型
+type RetryConfig struct {
+	MaxAttempts     int           // 包括第一次写入 Default: 5, 1 表示不重试
+	InitialBackoff  time.Duration // Default: 200ms
+	MaxBackoff      time.Duration // Default: 10s
+	MaxElapsed      time.Duration // 从第一次写入开始计算 Default: 2m
+	RetryableErrors []string      // 额外的可重试 es 错误类型
+}
+
+// retryableErrors are the elasticsearch error types of transient item failures
+var retryableErrors = []string{
+	"es_rejected_execution_exception",
+	"circuit_breaking_exception",
+	"unavailable_shards_exception",
+	"no_shard_available_action_exception",
+	"node_not_connected_exception",
+	"node_disconnected_exception",
+	"process_cluster_event_timeout_exception",
+	"receive_timeout_transport_exception",
+}
+
+type retrier struct {
+	cfg    RetryConfig
+	errors map[string]struct{}
+}
+
+func newRetrier(cfg RetryConfig) *retrier {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = 200 * time.Millisecond
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 10 * time.Second
+	}
+	if cfg.MaxElapsed <= 0 {
+		cfg.MaxElapsed = 2 * time.Minute
+	}
+	r := &retrier{
+		cfg:    cfg,
+		errors: make(map[string]struct{}),
+	}
+	for _, t := range retryableErrors {
+		r.errors[t] = struct{}{}
+	}
+	for _, t := range cfg.RetryableErrors {
+		r.errors[t] = struct{}{}
+	}
+	return r
+}
+
+// retryable reports whether the failure of a bulk item is transient.
+func (r *retrier) retryable(res esutil.BulkIndexerResponseItem, err error) bool {
+	if err != nil {
+		// the whole bulk request failed, a 4xx other than 429 fails again, the indexer closed at
+		// shutdown does not retry
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false
+		}
+		status := 0
+		var flushErr *flushError
+		if errors.As(err, &flushErr) {
+			status = flushErr.status
+		}
+		return status == 0 || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+	}
+	if _, ok := r.errors[res.Error.Type]; ok {
+		return true
+	}
+	return res.Status == http.StatusTooManyRequests || res.Status >= http.StatusInternalServerError
+}
+
+// next returns the jittered backoff before the next attempt, false when the budget is exhausted.
+func (r *retrier) next(attempts int, start time.Time) (time.Duration, bool) {
+	if attempts >= r.cfg.MaxAttempts {
+		return 0, false
+	}
+	backoff := r.cfg.InitialBackoff << (attempts - 1)
+	if backoff <= 0 || backoff > r.cfg.MaxBackoff {
+		backoff = r.cfg.MaxBackoff
+	}
+	// equal jitter: half of the backoff is random
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	if time.Since(start)+backoff > r.cfg.MaxElapsed {
+		return 0, false
+	}
+	return backoff, true
+}
@@ -0,0 +1,154 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7/esutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	r := newRetrier(RetryConfig{RetryableErrors: []string{"custom_exception"}})
+	item := func(status int, errorType string) esutil.BulkIndexerResponseItem {
+		res := esutil.BulkIndexerResponseItem{Status: status}
+		res.Error.Type = errorType
+		return res
+	}
+	tests := []struct {
+		name string
+		res  esutil.BulkIndexerResponseItem
+		err  error
+		want bool
+	}{
+		{"item 429", item(429, "es_rejected_execution_exception"), nil, true},
+		{"item 503", item(503, "unavailable_shards_exception"), nil, true},
+		{"item mapping", item(400, "mapper_parsing_exception"), nil, false},
+		{"item retryable type", item(400, "circuit_breaking_exception"), nil, true},
+		{"item custom type", item(400, "custom_exception"), nil, true},
+		{"request without response", item(0, ""), &flushError{err: errors.New("flush: connection refused")}, true},
+		{"request 429", item(0, ""), &flushError{status: 429, err: errors.New("flush: [429 Too Many Requests]")}, true},
+		{"request 502", item(0, ""), &flushError{status: 502, err: errors.New("flush: [502 Bad Gateway]")}, true},
+		{"request 413", item(0, ""), &flushError{status: 413, err: errors.New("flush: [413 Request Entity Too Large]")}, false},
+		{"request 400", item(0, ""), &flushError{status: 400, err: errors.New("flush: [400 Bad Request]")}, false},
+		{"no response for the item", item(0, ""), errNoResponse, true},
+		{"canceled", item(0, ""), context.Canceled, false},
+		{"closed at shutdown", item(0, ""), fmt.Errorf("%w: flush: context deadline exceeded", context.DeadlineExceeded), false},
+	}
+	for _, tt := range tests {
+		if got := r.retryable(tt.res, tt.err); got != tt.want {
+			t.Errorf("%s: retryable = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryNext(t *testing.T) {
+	r := newRetrier(RetryConfig{MaxAttempts: 5, InitialBackoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond, MaxElapsed: time.Minute})
+	start := time.Now()
+	for attempts, max := range []time.Duration{100, 200, 300, 300} {
+		max *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			backoff, ok := r.next(attempts+1, start)
+			if !ok {
+				t.Fatalf("attempt %d: no retry", attempts+1)
+			}
+			if backoff < max/2 || backoff > max {
+				t.Fatalf("attempt %d: backoff %s, want between %s and %s", attempts+1, backoff, max/2, max)
+			}
+		}
+	}
+	if _, ok := r.next(5, start); ok {
+		t.Error("retry after the last attempt")
+	}
+	if _, ok := r.next(1, start.Add(-time.Minute)); ok {
+		t.Error("retry after the max elapsed time")
+	}
+}
+
+func TestBulkFlushError(t *testing.T) {
+	r := newRetrier(RetryConfig{})
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{http.StatusRequestEntityTooLarge, false},
+		{http.StatusTooManyRequests, true},
+		{http.StatusServiceUnavailable, true},
+	}
+	for _, tt := range tests {
+		stub := &bulkStub{status: tt.status}
+		bi, err := newBulk(esutil.BulkIndexerConfig{Client: newClient(t, stub), NumWorkers: 1, FlushInterval: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		failed := make(chan error, 1)
+		err = bi.Add(context.Background(), esutil.BulkIndexerItem{
+			Action: "index",
+			Body:   strings.NewReader(`{"a":1}`),
+			OnFailure: func(_ context.Context, _ esutil.BulkIndexerItem, _ esutil.BulkIndexerResponseItem, err error) {
+				failed <- err
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = bi.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		err = <-failed
+		var flushErr *flushError
+		if !errors.As(err, &flushErr) || flushErr.status != tt.status {
+			t.Errorf("status %d: error %v, want a flush error with the status", tt.status, err)
+		}
+		if got := r.retryable(esutil.BulkIndexerResponseItem{}, err); got != tt.want {
+			t.Errorf("status %d: retryable = %t, want %t", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestBulkCloseDeadline(t *testing.T) {
+	// answers once the close deadline passed
+	release := make(chan struct{})
+	defer close(release)
+	stub := &bulkStub{}
+	client := newClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/_bulk") {
+			<-release
+		}
+		stub.ServeHTTP(w, r)
+	}))
+	bi, err := newBulk(esutil.BulkIndexerConfig{Client: client, NumWorkers: 1, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := make(chan error, 1)
+	err = bi.Add(context.Background(), esutil.BulkIndexerItem{
+		Action: "index",
+		Body:   strings.NewReader(`{"a":1}`),
+		OnFailure: func(_ context.Context, _ esutil.BulkIndexerItem, _ esutil.BulkIndexerResponseItem, err error) {
+			failed <- err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the worker reads the item before the close
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_ = bi.Close(ctx)
+	select {
+	case err = <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("item not failed at the close deadline")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if newRetrier(RetryConfig{}).retryable(esutil.BulkIndexerResponseItem{}, err) {
+		t.Error("item failed at the close deadline retried")
+	}
+}
@@ -0,0 +1,93 @@
+package indexer
+
+import (
+	"fmt"
+	"github.com/ydgo/k2es/charset"
+	"github.com/ydgo/k2es/codec"
+	"github.com/ydgo/k2es/processor"
+	"regexp"
+	"time"
+)
+
+// Route sends the messages of a topic to an index with its own bulk settings.
+// Routes writing the same index through the same pipeline share its bulk indexer, the settings
+// of the first one apply.
+type Route struct {
+	Topic         string             // exact topic name
+	TopicPattern  *regexp.Regexp     // matched when Topic is empty
+	Index         *Template          // index or alias
+	Pipeline      string             // ingest pipeline
+	Action        string             // index or create Default: index, create for data streams
+	DataStream    bool               // Index is a data stream, created on first use
+	ID            *IDStrategy        // Default: generated by elasticsearch
+	Metadata      *Metadata          // kafka metadata injected into the documents
+	Bucket        *Bucket            // time bucket appended to the index
+	Charset       *charset.Converter // Default: utf-8
+	Codec         *codec.Decoder     // Default: json
+	Processors    *processor.Chain
+	Workers       int           // Default: Config.Workers
+	FlushBytes    int           // Default: Config.FlushBytes
+	FlushInterval time.Duration // Default: Config.FlushInterval
+}
+
+func (r *Route) Validate() error {
+	if r.Topic == "" && r.TopicPattern == nil {
+		return fmt.Errorf("route topic or topic pattern is required")
+	}
+	if r.Index == nil {
+		return fmt.Errorf("route index is required")
+	}
+	if r.Action != "" && r.Action != "index" && r.Action != "create" {
+		return fmt.Errorf("route action must be either index or create: %s", r.Action)
+	}
+	if r.DataStream && r.Action == "index" {
+		return fmt.Errorf("data stream route action must be create")
+	}
+	if r.Bucket != nil {
+		if r.DataStream {
+			return fmt.Errorf("data streams are not bucketed by time")
+		}
+		if err := r.Bucket.Validate(); err != nil {
+			return err
+		}
+	}
+	if r.ID != nil {
+		if err := r.ID.Validate(); err != nil {
+			return err
+		}
+	}
+	if r.Workers < 0 || r.FlushBytes < 0 || r.FlushInterval < 0 {
+		return fmt.Errorf("invalid negative route bulk settings")
+	}
+	return nil
+}
+
+func (r *Route) match(topic string) bool {
+	if r.Topic != "" {
+		return r.Topic == topic
+	}
+	return r.TopicPattern.MatchString(topic)
+}
+
+func (r *Route) String() string {
+	if r.Topic != "" {
+		return r.Topic
+	}
+	return r.TopicPattern.String()
+}
+
+// Route returns the first route matching topic, or the default route of the config.
+func (mgmt *Mgmt) Route(topic string) *Route {
+	if value, ok := mgmt.routes.Load(topic); ok {
+		return value.(*Route)
+	}
+	route := mgmt.defaultRoute
+	for _, r := range mgmt.cfg.Routes {
+		if r.match(topic) {
+			route = r
+			break
+		}
+	}
+	mgmt.routes.Store(topic, route)
+	return route
+}
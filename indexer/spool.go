@@ -0,0 +1,640 @@
+package indexer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/elastic/go-elasticsearch/v7/esutil"
+	"github.com/segmentio/kafka-go"
+	"github.com/ydgo/k2es/deadletter"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const segmentExt = ".ndjson"
+
+// recordLines are the lines of a spooled document: its origin, the bulk action and the source
+const recordLines = 3
+
+// maxSpoolBatch is the maximum number of records synced at once
+const maxSpoolBatch = 1024
+
+var (
+	errSpoolFull   = errors.New("spool is full")
+	errSpoolClosed = errors.New("spool is closed")
+)
+
+// SpoolConfig 磁盘缓存, es 不可用时保存写入失败的文档, 恢复后按顺序重放
+type SpoolConfig struct {
+	Dir            string             // 为空时不启用
+	SegmentBytes   int64              // 单个文件大小 Default: 64MB
+	MaxBytes       int64              // 总大小 Default: 1GB
+	ReplayInterval time.Duration      // 检查集群状态并重放的间隔 Default: 10s
+	FlushBytes     int                // 重放时单个 bulk 请求的大小 Default: 5MB
+	DeadLetter     *deadletter.Writer // 重放时被 es 拒绝的文档写入死信 topic, 为 nil 时丢弃
+}
+
+// Spool is a write-ahead log of bulk actions, stored in segment files of the directory
+// named after their sequence number. Segments are replayed in order once the cluster is not red.
+// Each action is preceded by its kafka message, dead lettered when elasticsearch rejects it.
+type Spool struct {
+	ctx context.Context
+	cfg SpoolConfig
+	es  *elasticsearch.Client
+
+	appends chan spoolAppend
+	written chan struct{} // closed once the appends are written
+	closing sync.RWMutex
+	closed  bool
+
+	mux      sync.Mutex
+	seq      uint64
+	current  *os.File
+	size     int64    // bytes of the current segment
+	segments []string // sealed segments, oldest first
+	bytes    int64
+	actions  int64
+}
+
+type spoolAppend struct {
+	record []byte
+	done   func(error)
+}
+
+// spoolOrigin is the kafka message of a spooled action
+type spoolOrigin struct {
+	Topic     string         `json:"topic"`
+	Partition int            `json:"partition"`
+	Offset    int64          `json:"offset"`
+	Key       []byte         `json:"key,omitempty"`
+	Value     []byte         `json:"value"`
+	Headers   []kafka.Header `json:"headers,omitempty"`
+}
+
+type SpoolStats struct {
+	Segments int
+	Bytes    int64
+	Actions  int64
+}
+
+// NewSpool opens the spool directory and starts replaying the segments left by a previous run.
+func NewSpool(ctx context.Context, es *elasticsearch.Client, cfg SpoolConfig) (*Spool, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("spool dir is required")
+	}
+	if cfg.SegmentBytes <= 0 {
+		cfg.SegmentBytes = 64 << 20
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 1 << 30
+	}
+	if cfg.ReplayInterval <= 0 {
+		cfg.ReplayInterval = 10 * time.Second
+	}
+	if cfg.FlushBytes <= 0 {
+		cfg.FlushBytes = 5e+6
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		ctx:     ctx,
+		cfg:     cfg,
+		es:      es,
+		appends: make(chan spoolAppend, maxSpoolBatch),
+		written: make(chan struct{}),
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if entry.IsDir() || filepath.Ext(name) != segmentExt || err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		if seq > s.seq {
+			s.seq = seq
+		}
+		s.segments = append(s.segments, filepath.Join(cfg.Dir, name))
+		s.bytes += info.Size()
+		s.actions += countActions(filepath.Join(cfg.Dir, name))
+	}
+	sort.Strings(s.segments)
+	go s.writeLoop()
+	go s.replay()
+	return s, nil
+}
+
+func countActions(file string) int64 {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	var lines int64
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines / recordLines
+}
+
+// Append queues a record of the bulk action of body and of msg, the kafka message it comes
+// from, done is called once the record is durable. The records queued meanwhile share the
+// fsync, so that the documents of a failed bulk request are not synced one by one.
+func (s *Spool) Append(msg kafka.Message, index, action, pipeline, id string, body []byte, done func(error)) {
+	record, err := newRecord(msg, index, action, pipeline, id, body)
+	if err != nil {
+		done(err)
+		return
+	}
+	s.closing.RLock()
+	defer s.closing.RUnlock()
+	if s.closed {
+		done(errSpoolClosed)
+		return
+	}
+	s.appends <- spoolAppend{record: record, done: done}
+}
+
+// newRecord returns the origin, action and source lines of a spooled document.
+func newRecord(msg kafka.Message, index, action, pipeline, id string, body []byte) ([]byte, error) {
+	origin, err := json.Marshal(spoolOrigin{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       msg.Key,
+		Value:     msg.Value,
+		Headers:   msg.Headers,
+	})
+	if err != nil {
+		return nil, err
+	}
+	meta := map[string]map[string]string{action: {"_index": index}}
+	if pipeline != "" {
+		meta[action]["pipeline"] = pipeline
+	}
+	if id != "" {
+		meta[action]["_id"] = id
+	}
+	line, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(origin)
+	buf.WriteByte('\n')
+	buf.Write(line)
+	buf.WriteByte('\n')
+	// a bulk source must fit on one line
+	if err = json.Compact(&buf, body); err != nil {
+		return nil, fmt.Errorf("compact document: %w", err)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// writeLoop writes the queued records until the spool is closed.
+func (s *Spool) writeLoop() {
+	defer close(s.written)
+	for a := range s.appends {
+		batch := []spoolAppend{a}
+	queued:
+		for len(batch) < maxSpoolBatch {
+			select {
+			case a, ok := <-s.appends:
+				if !ok {
+					break queued
+				}
+				batch = append(batch, a)
+			default:
+				break queued
+			}
+		}
+		errs := s.write(batch)
+		for i, a := range batch {
+			a.done(errs[i])
+		}
+	}
+}
+
+// write appends the records of batch to the current segment and syncs it once, it returns
+// the error of each record.
+func (s *Spool) write(batch []spoolAppend) []error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	errs := make([]error, len(batch))
+	written := make([]int, 0, len(batch))
+	for i, a := range batch {
+		if s.bytes+int64(len(a.record)) > s.cfg.MaxBytes {
+			errs[i] = errSpoolFull
+			continue
+		}
+		if s.current != nil && s.size+int64(len(a.record)) > s.cfg.SegmentBytes {
+			if err := s.seal(); err != nil {
+				errs[i] = err
+				continue
+			}
+		}
+		if s.current == nil {
+			s.seq++
+			f, err := os.OpenFile(s.segment(s.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			s.current, s.size = f, 0
+		}
+		if _, err := s.current.Write(a.record); err != nil {
+			errs[i] = err
+			continue
+		}
+		s.size += int64(len(a.record))
+		s.bytes += int64(len(a.record))
+		s.actions++
+		written = append(written, i)
+	}
+	if s.current != nil && len(written) > 0 {
+		if err := s.current.Sync(); err != nil {
+			for _, i := range written {
+				errs[i] = err
+			}
+		}
+	}
+	return errs
+}
+
+func (s *Spool) segment(seq uint64) string {
+	return filepath.Join(s.cfg.Dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+// seal closes the current segment and queues it for replay, the caller holds the lock.
+func (s *Spool) seal() error {
+	if s.current == nil {
+		return nil
+	}
+	name := s.current.Name()
+	err := s.current.Sync()
+	if closeErr := s.current.Close(); err == nil {
+		err = closeErr
+	}
+	s.current = nil
+	s.segments = append(s.segments, name)
+	return err
+}
+
+func (s *Spool) Stats() SpoolStats {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	segments := len(s.segments)
+	if s.current != nil {
+		segments++
+	}
+	return SpoolStats{
+		Segments: segments,
+		Bytes:    s.bytes,
+		Actions:  s.actions,
+	}
+}
+
+// Close writes the queued records and closes the current segment, it is replayed by the next run.
+func (s *Spool) Close() error {
+	s.closing.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.appends)
+	}
+	s.closing.Unlock()
+	<-s.written
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.seal()
+}
+
+func (s *Spool) replay() {
+	ticker := time.NewTicker(s.cfg.ReplayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mux.Lock()
+			if len(s.segments) == 0 && s.current != nil {
+				_ = s.seal()
+			}
+			s.mux.Unlock()
+			if s.Stats().Segments == 0 || !s.healthy() {
+				continue
+			}
+			for s.ctx.Err() == nil {
+				s.mux.Lock()
+				if len(s.segments) == 0 {
+					s.mux.Unlock()
+					break
+				}
+				segment := s.segments[0]
+				s.mux.Unlock()
+				if err := s.replaySegment(segment); err != nil {
+					log.Printf("spool replay %s: %s", segment, err)
+					break
+				}
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// healthy reports whether the cluster accepts writes again.
+func (s *Spool) healthy() bool {
+	res, err := esapi.ClusterHealthRequest{Timeout: 5 * time.Second}.Do(s.ctx, s.es)
+	if err != nil {
+		return false
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return false
+	}
+	var health struct {
+		Status string `json:"status"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&health); err != nil {
+		return false
+	}
+	return health.Status != "red"
+}
+
+// requestRejected is a bulk request refused as a whole with a 4xx other than 429, such as the
+// 413 of a request larger than http.max_content_length: it fails again when sent again.
+type requestRejected struct {
+	status    int
+	errorType string
+	reason    string
+}
+
+func (e *requestRejected) Error() string {
+	return fmt.Sprintf("bulk request rejected with status %d: %s: %s", e.status, e.errorType, e.reason)
+}
+
+// replaySegment sends the actions of a segment in bulk requests of FlushBytes and removes it.
+// It stops at the first failed request or retryable action, the segment is then rewritten with
+// the actions left so that the indexed ones are not sent again. A request rejected as a whole
+// is split until the action refused alone is dead lettered.
+func (s *Spool) replaySegment(segment string) error {
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		return err
+	}
+	records := splitRecords(data)
+	keep := make([][]byte, 0)
+	limit := len(records) // actions of a request, halved when a request is rejected as a whole
+	for start := 0; start < len(records); {
+		end, size := start, 0
+		for end < len(records) && end-start < limit && (end == start || size+len(records[end]) <= s.cfg.FlushBytes) {
+			size += len(records[end])
+			end++
+		}
+		var kept [][]byte
+		kept, err = s.replayRecords(records[start:end])
+		var rejected *requestRejected
+		if errors.As(err, &rejected) {
+			if end-start > 1 {
+				limit = (end - start) / 2
+				continue
+			}
+			log.Printf("spool replay %s: %s", segment, err)
+			kept, err = nil, nil
+			if !s.reject(records[start], deadletter.Rejection{Index: recordIndex(records[start]), ErrorType: rejected.errorType, ErrorReason: rejected.reason}) {
+				kept = records[start:end]
+			}
+		}
+		if err != nil {
+			keep = append(keep, records[start:]...)
+			break
+		}
+		if len(kept) > 0 {
+			keep = append(append(keep, kept...), records[end:]...)
+			err = fmt.Errorf("%d retryable actions kept", len(kept))
+			break
+		}
+		start = end
+	}
+	if len(keep) == len(records) && err != nil {
+		return err
+	}
+
+	if len(keep) > 0 {
+		if rewriteErr := rewrite(segment, keep); rewriteErr != nil {
+			return fmt.Errorf("rewrite: %w", rewriteErr)
+		}
+	} else if removeErr := os.Remove(segment); removeErr != nil {
+		log.Printf("spool remove %s: %s", segment, removeErr)
+	}
+	kept := 0
+	for _, record := range keep {
+		kept += len(record)
+	}
+	s.mux.Lock()
+	if len(keep) == 0 {
+		s.segments = s.segments[1:]
+	}
+	s.bytes -= int64(len(data) - kept)
+	s.actions -= int64(len(records) - len(keep))
+	s.mux.Unlock()
+	return err
+}
+
+// replayRecords sends records as one bulk request, it returns the records to send again: the
+// actions failed with 429 or 5xx, and the rejected ones the dead letter topic did not accept.
+func (s *Spool) replayRecords(records [][]byte) ([][]byte, error) {
+	var body bytes.Buffer
+	for _, record := range records {
+		body.Write(record[bytes.IndexByte(record, '\n')+1:])
+	}
+	res, err := esapi.BulkRequest{Body: &body}.Do(s.ctx, s.es)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= http.StatusInternalServerError {
+			return nil, fmt.Errorf("%s", res.String())
+		}
+		rejected := &requestRejected{status: res.StatusCode, errorType: "request_rejected", reason: http.StatusText(res.StatusCode)}
+		var e struct {
+			Error struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		}
+		if json.NewDecoder(res.Body).Decode(&e) == nil && e.Error.Type != "" {
+			rejected.errorType, rejected.reason = e.Error.Type, e.Error.Reason
+		}
+		return nil, rejected
+	}
+	var blk esutil.BulkIndexerResponse
+	if err = json.NewDecoder(res.Body).Decode(&blk); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	kept := make([][]byte, 0)
+	if len(blk.Items) < len(records) {
+		kept = append(kept, records[len(blk.Items):]...)
+	}
+	var rejected int
+	for i, item := range blk.Items {
+		if i >= len(records) {
+			break
+		}
+		record := records[i]
+		for action, res := range item {
+			switch {
+			case res.Status == http.StatusTooManyRequests || res.Status >= http.StatusInternalServerError:
+				mux.Lock()
+				kept = append(kept, record)
+				mux.Unlock()
+			case res.Status == http.StatusConflict && action == "create":
+				// created by a previous delivery of the document
+			case res.Status > 299:
+				rejected++
+				if rejected == 1 {
+					log.Printf("spool replay %s rejected %s:%s", res.Index, res.Error.Type, res.Error.Reason)
+				}
+				wg.Add(1)
+				s.deadLetter(record, deadletter.Rejection{
+					Index:       res.Index,
+					ErrorType:   res.Error.Type,
+					ErrorReason: res.Error.Reason,
+				}, func(err error) {
+					defer wg.Done()
+					if err != nil {
+						mux.Lock()
+						kept = append(kept, record)
+						mux.Unlock()
+					}
+				})
+			}
+		}
+	}
+	wg.Wait()
+	if rejected > 0 {
+		log.Printf("spool replay: %d actions rejected by elasticsearch", rejected)
+	}
+	return kept, nil
+}
+
+// deadLetter sends the message of a rejected record to the dead letter topic, done is called with
+// the error of the topic. The record is dropped without dead letter topic or origin.
+func (s *Spool) deadLetter(record []byte, rejection deadletter.Rejection, done func(error)) {
+	if s.cfg.DeadLetter == nil {
+		done(nil)
+		return
+	}
+	var origin spoolOrigin
+	if err := json.Unmarshal(record[:bytes.IndexByte(record, '\n')], &origin); err != nil {
+		log.Printf("spool replay origin: %s", err)
+		done(nil)
+		return
+	}
+	s.cfg.DeadLetter.Send(context.Background(), origin.message(), rejection, func(err error) {
+		if err != nil {
+			log.Printf("spool replay dead letter: %s", err)
+		}
+		done(err)
+	})
+}
+
+// reject dead letters a record and waits for it, it returns false when the record is kept.
+func (s *Spool) reject(record []byte, rejection deadletter.Rejection) bool {
+	sent := make(chan error, 1)
+	s.deadLetter(record, rejection, func(err error) {
+		sent <- err
+	})
+	return <-sent == nil
+}
+
+// recordIndex returns the index of the action of a record.
+func recordIndex(record []byte) string {
+	lines := bytes.SplitN(record, []byte("\n"), recordLines)
+	var meta map[string]struct {
+		Index string `json:"_index"`
+	}
+	if len(lines) < 2 || json.Unmarshal(lines[1], &meta) != nil {
+		return ""
+	}
+	for _, action := range meta {
+		return action.Index
+	}
+	return ""
+}
+
+// splitRecords returns the records of a segment, without the partial record of an interrupted write.
+func splitRecords(data []byte) [][]byte {
+	records := make([][]byte, 0)
+	for start, lines, i := 0, 0, 0; i < len(data); i++ {
+		if data[i] != '\n' {
+			continue
+		}
+		if lines++; lines == recordLines {
+			records = append(records, data[start:i+1])
+			start, lines = i+1, 0
+		}
+	}
+	return records
+}
+
+// rewrite replaces segment with records.
+func rewrite(segment string, records [][]byte) error {
+	tmp := segment + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if _, err = f.Write(record); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, segment)
+}
+
+func (o spoolOrigin) message() kafka.Message {
+	return kafka.Message{
+		Topic:     o.Topic,
+		Partition: o.Partition,
+		Offset:    o.Offset,
+		Key:       o.Key,
+		Value:     o.Value,
+		Headers:   o.Headers,
+	}
+}
@@ -0,0 +1,153 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newSpool(t *testing.T, stub *bulkStub, cfg SpoolConfig) *Spool {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if cfg.Dir == "" {
+		cfg.Dir = t.TempDir()
+	}
+	s, err := NewSpool(ctx, newClient(t, stub), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func appendDoc(t *testing.T, s *Spool, doc string) {
+	t.Helper()
+	done := make(chan error, 1)
+	s.Append(kafka.Message{Topic: "logs", Value: []byte(doc)}, "k2es", "index", "", "", []byte(doc), func(err error) {
+		done <- err
+	})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeSegment writes the records of docs to the segment seq of dir, followed by tail.
+func writeSegment(t *testing.T, dir string, seq int, tail string, docs ...string) {
+	t.Helper()
+	var data bytes.Buffer
+	for _, doc := range docs {
+		record, err := newRecord(kafka.Message{Topic: "logs", Value: []byte(doc)}, "k2es", "index", "", "", []byte(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data.Write(record)
+	}
+	data.WriteString(tail)
+	if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%020d%s", seq, segmentExt)), data.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitReplayed waits for the spool to be empty and returns the documents indexed by stub.
+func waitReplayed(t *testing.T, s *Spool, stub *bulkStub) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for stats := s.Stats(); stats.Segments > 0 || stats.Actions > 0; stats = s.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("spool not replayed: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stub.mux.Lock()
+	defer stub.mux.Unlock()
+	return append([]string(nil), stub.sources...)
+}
+
+func TestSpoolWrite(t *testing.T) {
+	dir := t.TempDir()
+	stub := &bulkStub{}
+	// no replay during the test
+	cfg := SpoolConfig{Dir: dir, SegmentBytes: 300, ReplayInterval: time.Hour}
+	s := newSpool(t, stub, cfg)
+	docs := []string{`{"a":1}`, `{"a":2}`, `{"a":3}`}
+	for _, doc := range docs {
+		appendDoc(t, s, doc)
+	}
+	stats := s.Stats()
+	if stats.Actions != 3 || stats.Segments < 2 {
+		t.Errorf("stats = %+v, want 3 actions in several segments", stats)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	s.Append(kafka.Message{}, "k2es", "index", "", "", []byte(`{}`), func(err error) { done <- err })
+	if err := <-done; err != errSpoolClosed {
+		t.Errorf("append after close: %v, want %v", err, errSpoolClosed)
+	}
+	// the segments left are replayed by the next run
+	reopened := newSpool(t, stub, cfg)
+	if got := reopened.Stats(); got != stats {
+		t.Errorf("stats = %+v after reopening, want %+v", got, stats)
+	}
+	full := newSpool(t, stub, SpoolConfig{MaxBytes: 100, ReplayInterval: time.Hour})
+	full.Append(kafka.Message{}, "k2es", "index", "", "", []byte(`{"a":"`+string(bytes.Repeat([]byte("x"), 100))+`"}`), func(err error) { done <- err })
+	if err := <-done; err != errSpoolFull {
+		t.Errorf("append beyond max bytes: %v, want %v", err, errSpoolFull)
+	}
+}
+
+func TestSpoolReplay(t *testing.T) {
+	stub := &bulkStub{}
+	s := newSpool(t, stub, SpoolConfig{ReplayInterval: 10 * time.Millisecond})
+	docs := []string{`{"a":1}`, `{"a":2}`, `{"a":3}`}
+	for _, doc := range docs {
+		appendDoc(t, s, doc)
+	}
+	if got := waitReplayed(t, s, stub); !reflect.DeepEqual(got, docs) {
+		t.Errorf("replayed %v, want %v", got, docs)
+	}
+	entries, _ := os.ReadDir(s.cfg.Dir)
+	if len(entries) != 0 {
+		t.Errorf("%d files left after the replay", len(entries))
+	}
+}
+
+func TestSpoolPoisonSegment(t *testing.T) {
+	dir := t.TempDir()
+	writeSegment(t, dir, 1, "", `{"a":1}`, `{"poison":true}`, `{"a":2}`)
+	writeSegment(t, dir, 2, "", `{"a":3}`)
+	stub := &bulkStub{request: func(body []byte) int {
+		if bytes.Contains(body, []byte("poison")) {
+			return http.StatusRequestEntityTooLarge
+		}
+		return http.StatusOK
+	}}
+	s := newSpool(t, stub, SpoolConfig{Dir: dir, ReplayInterval: 10 * time.Millisecond})
+	want := []string{`{"a":1}`, `{"a":2}`, `{"a":3}`}
+	if got := waitReplayed(t, s, stub); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %v, want %v without the rejected action", got, want)
+	}
+}
+
+func TestSpoolCorruptTail(t *testing.T) {
+	dir := t.TempDir()
+	// a write interrupted after the origin of the third record
+	writeSegment(t, dir, 1, `{"topic":"logs","partition":0,"offset":3,"value":"e30="}`+"\n", `{"a":1}`, `{"a":2}`)
+	stub := &bulkStub{}
+	s := newSpool(t, stub, SpoolConfig{Dir: dir, ReplayInterval: 10 * time.Millisecond})
+	if stats := s.Stats(); stats.Actions != 2 {
+		t.Errorf("actions = %d, want 2 without the partial record", stats.Actions)
+	}
+	want := []string{`{"a":1}`, `{"a":2}`}
+	if got := waitReplayed(t, s, stub); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+}
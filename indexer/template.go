@@ -0,0 +1,271 @@
+package indexer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Template is an index name template evaluated against every message, such as
+//
+//	logs-{{_datamodel}}-{{_time|date "2006.01.02"}}
+//
+// A placeholder names a json field of the message, nested fields are separated by dots,
+// or one of the kafka metadata @topic, @partition, @offset, @key and @timestamp.
+// The date filter formats an epoch_millis or RFC3339 value with a go time layout, in UTC or
+// in the timezone of its second argument, such as {{_time|date "2006.01.02" "Asia/Shanghai"}}.
+// When a field is missing the message is routed to the fallback index.
+type Template struct {
+	text     string
+	parts    []templatePart
+	fallback string
+}
+
+type templatePart struct {
+	literal string
+	field   string
+	filters []templateFilter
+}
+
+type templateFilter struct {
+	name     string
+	arg      string
+	location *time.Location
+}
+
+// ParseTemplate parses text, fallback is the index used when the template can not be evaluated.
+func ParseTemplate(text, fallback string) (*Template, error) {
+	t := &Template{text: text, fallback: sanitize(fallback)}
+	if t.fallback == "" {
+		return nil, fmt.Errorf("invalid fallback index %q", fallback)
+	}
+	for rest := text; rest != ""; {
+		start := strings.Index(rest, "{{")
+		if start < 0 {
+			t.parts = append(t.parts, templatePart{literal: rest})
+			break
+		}
+		if start > 0 {
+			t.parts = append(t.parts, templatePart{literal: rest[:start]})
+		}
+		end := strings.Index(rest[start:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed placeholder in %q", text)
+		}
+		part, err := parsePlaceholder(rest[start+2 : start+end])
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", text, err)
+		}
+		t.parts = append(t.parts, part)
+		rest = rest[start+end+2:]
+	}
+	if len(t.parts) == 0 {
+		return nil, fmt.Errorf("empty index template")
+	}
+	return t, nil
+}
+
+func parsePlaceholder(text string) (templatePart, error) {
+	pipes := strings.Split(text, "|")
+	part := templatePart{field: strings.TrimSpace(pipes[0])}
+	if part.field == "" {
+		return part, fmt.Errorf("empty placeholder")
+	}
+	for _, pipe := range pipes[1:] {
+		pipe = strings.TrimSpace(pipe)
+		name, arg, _ := strings.Cut(pipe, " ")
+		filter := templateFilter{name: name}
+		switch name {
+		case "date":
+			arg = strings.TrimSpace(arg)
+			quoted, err := strconv.QuotedPrefix(arg)
+			if err != nil {
+				return part, fmt.Errorf("date filter requires a quoted layout: %q", pipe)
+			}
+			if filter.arg, _ = strconv.Unquote(quoted); filter.arg == "" {
+				return part, fmt.Errorf("date filter requires a quoted layout: %q", pipe)
+			}
+			filter.location = time.UTC
+			if timezone := strings.TrimSpace(arg[len(quoted):]); timezone != "" {
+				name, err := strconv.Unquote(timezone)
+				if err != nil {
+					return part, fmt.Errorf("date filter timezone must be quoted: %q", pipe)
+				}
+				if filter.location, err = time.LoadLocation(name); err != nil {
+					return part, fmt.Errorf("date filter: %w", err)
+				}
+			}
+		default:
+			return part, fmt.Errorf("unknown filter %q", name)
+		}
+		part.filters = append(part.filters, filter)
+	}
+	return part, nil
+}
+
+func (t *Template) String() string {
+	return t.text
+}
+
+// Execute returns the sanitised index name of msg.
+func (t *Template) Execute(msg kafka.Message) string {
+	return t.execute(msg, newMessageFields(msg.Value))
+}
+
+func (t *Template) execute(msg kafka.Message, f *messageFields) string {
+	var fields map[string]json.RawMessage
+	var builder strings.Builder
+	for _, part := range t.parts {
+		if part.field == "" {
+			builder.WriteString(part.literal)
+			continue
+		}
+		if fields == nil && !strings.HasPrefix(part.field, "@") {
+			var err error
+			if fields, err = f.get(); err != nil {
+				return t.fallback
+			}
+		}
+		value, ok := lookup(msg, fields, part.field)
+		if !ok {
+			return t.fallback
+		}
+		for _, filter := range part.filters {
+			if value, ok = filter.apply(value); !ok {
+				return t.fallback
+			}
+		}
+		builder.WriteString(value)
+	}
+	if index := sanitize(builder.String()); index != "" {
+		return index
+	}
+	return t.fallback
+}
+
+// messageFields are the top level json fields of a message, decoded once for the index
+// template, the id, the time bucket, the data stream and the latency of its document.
+type messageFields struct {
+	value   []byte
+	decoded bool
+	fields  map[string]json.RawMessage
+	err     error
+}
+
+func newMessageFields(value []byte) *messageFields {
+	return &messageFields{value: value}
+}
+
+// get decodes the message on the first call.
+func (f *messageFields) get() (map[string]json.RawMessage, error) {
+	if !f.decoded {
+		f.decoded = true
+		f.err = json.Unmarshal(f.value, &f.fields)
+	}
+	return f.fields, f.err
+}
+
+// lookup returns the string value of a kafka metadata or a json field.
+func lookup(msg kafka.Message, fields map[string]json.RawMessage, name string) (string, bool) {
+	switch name {
+	case "@topic":
+		return msg.Topic, true
+	case "@partition":
+		return strconv.Itoa(msg.Partition), true
+	case "@offset":
+		return strconv.FormatInt(msg.Offset, 10), true
+	case "@key":
+		return string(msg.Key), len(msg.Key) > 0
+	case "@timestamp":
+		return strconv.FormatInt(msg.Time.UnixMilli(), 10), !msg.Time.IsZero()
+	}
+	path := strings.Split(name, ".")
+	raw, ok := fields[path[0]]
+	for _, key := range path[1:] {
+		if !ok {
+			return "", false
+		}
+		var nested map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &nested); err != nil {
+			return "", false
+		}
+		raw, ok = nested[key]
+	}
+	if !ok {
+		return "", false
+	}
+	return scalar(raw)
+}
+
+// scalar returns the text of a json string, number or bool.
+func scalar(raw json.RawMessage) (string, bool) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return "", false
+	}
+	switch raw[0] {
+	case '"':
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil || s == "" {
+			return "", false
+		}
+		return s, true
+	case '{', '[', 'n':
+		return "", false
+	}
+	return string(raw), true
+}
+
+func (f templateFilter) apply(value string) (string, bool) {
+	switch f.name {
+	case "date":
+		t, ok := parseTime(value)
+		if !ok {
+			return "", false
+		}
+		return t.In(f.location).Format(f.arg), true
+	}
+	return "", false
+}
+
+// parseTime parses an epoch_millis or RFC3339 time.
+func parseTime(value string) (time.Time, bool) {
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(millis), true
+	}
+	if millis, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.UnixMilli(int64(millis)), true
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	return t, err == nil
+}
+
+// sanitize turns name into a legal elasticsearch index name, it returns "" when impossible.
+func sanitize(name string) string {
+	name = strings.ToLower(name)
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '\\', '/', '*', '?', '"', '<', '>', '|', ' ', ',', '#', ':':
+			return '_'
+		}
+		if r < ' ' || r == utf8.RuneError {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(name, "-_+")
+	// index names are limited to 255 bytes
+	for len(name) > 255 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "." || name == ".." {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,206 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"github.com/elastic/go-elasticsearch/v7/esutil"
+	"github.com/segmentio/kafka-go"
+	"github.com/ydgo/k2es/breaker"
+	"github.com/ydgo/k2es/deadletter"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// writer turns kafka messages into bulk items and settles them once elasticsearch answered:
+// retryable failures are added again, rejected documents go to the dead letter topic.
+type writer struct {
+	add        func(ctx context.Context, doc *document, item esutil.BulkIndexerItem) error
+	deadLetter *deadletter.Writer
+	retry      *retrier
+	spool      *Spool
+	breaker    *breaker.Breaker
+	latency    *Latency
+
+	idFallbacks sync.Map // topic -> *uint64, documents without the id of the strategy
+}
+
+type document struct {
+	ctx       context.Context
+	route     *Route
+	index     string
+	id        string
+	msg       kafka.Message
+	body      []byte
+	ack       func(error)
+	attempts  int
+	start     time.Time
+	eventTime time.Time // TimeField of the document for the latency, zero when missing
+}
+
+// write adds msg to the bulk indexer, ack is called once elasticsearch acknowledged the document.
+// fields are the json fields of msg, decoded once for all the settings of the route.
+func (w *writer) write(ctx context.Context, route *Route, index string, msg kafka.Message, fields *messageFields, ack func(error)) error {
+	doc := &document{
+		ctx:      ctx,
+		route:    route,
+		index:    index,
+		msg:      msg,
+		body:     msg.Value,
+		ack:      ack,
+		attempts: 1,
+		start:    time.Now(),
+	}
+	id, ok := route.ID.id(msg, fields)
+	if !ok {
+		w.idFallback(msg.Topic)
+	}
+	doc.id = id
+	if w.latency != nil {
+		doc.eventTime, _ = eventTime(fields)
+	}
+	if route.Bucket != nil {
+		bucketed, err := route.Bucket.index(index, msg, fields)
+		if err != nil {
+			w.reject(doc, errTimeOutOfRange, err.Error())
+			return nil
+		}
+		doc.index = bucketed
+	}
+	if route.DataStream {
+		body, err := prepareDataStream(msg.Value, fields)
+		if err != nil {
+			w.reject(doc, errMissingTimestamp, err.Error())
+			return nil
+		}
+		doc.body = body
+	}
+	doc.body = route.Metadata.inject(msg, doc.body)
+	return w.add(ctx, doc, w.item(doc))
+}
+
+// idFallback counts a document of topic whose id is generated by elasticsearch, as the id
+// strategy could not derive it.
+func (w *writer) idFallback(topic string) {
+	n, ok := w.idFallbacks.Load(topic)
+	if !ok {
+		n, _ = w.idFallbacks.LoadOrStore(topic, new(uint64))
+	}
+	atomic.AddUint64(n.(*uint64), 1)
+}
+
+// reject settles doc as a document elasticsearch refused without sending it.
+func (w *writer) reject(doc *document, errorType, reason string) {
+	res := esutil.BulkIndexerResponseItem{Index: doc.index, Status: http.StatusBadRequest}
+	res.Error.Type, res.Error.Reason = errorType, reason
+	w.onFailure(doc, res, nil)
+}
+
+func (w *writer) item(doc *document) esutil.BulkIndexerItem {
+	return esutil.BulkIndexerItem{
+		Index:      doc.index,
+		Action:     doc.route.Action,
+		DocumentID: doc.id,
+		Body:       bytes.NewReader(doc.body),
+		OnSuccess: func(context.Context, esutil.BulkIndexerItem, esutil.BulkIndexerResponseItem) {
+			w.breaker.Success()
+			w.latency.observe(doc)
+			doc.ack(nil)
+		},
+		OnFailure: func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
+			w.onFailure(doc, res, err)
+		},
+	}
+}
+
+func (w *writer) onFailure(doc *document, res esutil.BulkIndexerResponseItem, err error) {
+	if err == nil && doc.id != "" && doc.route.Action == "create" && res.Status == http.StatusConflict {
+		// created by a previous delivery of the message
+		doc.ack(nil)
+		return
+	}
+	if reason, ok := blocked(res, err); ok && w.breaker != nil {
+		// elasticsearch refuses the writes, the document is added again once the breaker closes
+		w.breaker.Trip(res.Index, reason)
+		doc.attempts++
+		go func() {
+			if err := w.breaker.WaitClosed(doc.ctx); err != nil {
+				doc.ack(err)
+				return
+			}
+			if err := w.add(doc.ctx, doc, w.item(doc)); err != nil {
+				doc.ack(err)
+			}
+		}()
+		return
+	}
+	if w.retry.retryable(res, err) {
+		if backoff, ok := w.retry.next(doc.attempts, doc.start); ok {
+			doc.attempts++
+			time.AfterFunc(backoff, func() {
+				if doc.ctx.Err() != nil {
+					doc.ack(doc.ctx.Err())
+					return
+				}
+				if err := w.add(doc.ctx, doc, w.item(doc)); err != nil {
+					doc.ack(err)
+				}
+			})
+			return
+		}
+	}
+	if w.spool != nil && w.retry.retryable(res, err) {
+		// elasticsearch is unavailable, the document is acknowledged once spooled
+		original := deadletter.Original(doc.ctx, doc.msg)
+		w.spool.Append(original, doc.index, doc.route.Action, doc.route.Pipeline, doc.id, doc.body, func(spoolErr error) {
+			if spoolErr == nil {
+				doc.ack(nil)
+				return
+			}
+			log.Printf("spool %s: %s", doc.index, spoolErr)
+			w.fail(doc, res, err)
+		})
+		return
+	}
+	w.fail(doc, res, err)
+}
+
+// fail settles doc once it will not be indexed.
+func (w *writer) fail(doc *document, res esutil.BulkIndexerResponseItem, err error) {
+	onFail(doc, res, err)
+	if err != nil || w.deadLetter == nil {
+		// the document was rejected by elasticsearch, it is acknowledged as handled,
+		// while a request error leaves it unacknowledged to be consumed again.
+		doc.ack(err)
+		return
+	}
+	w.deadLetter.Send(doc.ctx, doc.msg, deadletter.Rejection{
+		Index:       doc.index,
+		ErrorType:   res.Error.Type,
+		ErrorReason: res.Error.Reason,
+	}, doc.ack)
+}
+
+// blocked returns the reason of a write refused by a cluster block, such as the
+// read_only_allow_delete block (FORBIDDEN/12) of the flood stage disk watermark.
+func blocked(res esutil.BulkIndexerResponseItem, err error) (string, bool) {
+	if err != nil {
+		return err.Error(), strings.Contains(err.Error(), "cluster_block_exception")
+	}
+	return res.Error.Reason, res.Error.Type == "cluster_block_exception"
+}
+
+func onFail(doc *document, res esutil.BulkIndexerResponseItem, err error) {
+	if err != nil {
+		log.Printf("indexed %s after %d attempts: %s", doc.index, doc.attempts, err)
+	} else if res.Error.Type != "" {
+		if hint := dataStreamHint(res); doc.route.DataStream && hint != "" {
+			log.Printf("indexed data stream %s after %d attempts %s:%s (%s)", doc.index, doc.attempts, res.Error.Type, res.Error.Reason, hint)
+			return
+		}
+		log.Printf("indexed %s after %d attempts %s:%s", doc.index, doc.attempts, res.Error.Type, res.Error.Reason)
+	}
+}
@@ -2,19 +2,34 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/segmentio/kafka-go"
+	"github.com/ydgo/k2es/breaker"
+	"github.com/ydgo/k2es/charset"
+	"github.com/ydgo/k2es/codec"
 	"github.com/ydgo/k2es/collectors"
 	"github.com/ydgo/k2es/config"
+	"github.com/ydgo/k2es/data"
+	"github.com/ydgo/k2es/deadletter"
+	"github.com/ydgo/k2es/fasthttp"
+	"github.com/ydgo/k2es/flow"
 	"github.com/ydgo/k2es/group"
 	"github.com/ydgo/k2es/indexer"
+	"github.com/ydgo/k2es/processor"
+	"github.com/ydgo/k2es/security"
+	"github.com/ydgo/k2es/templates"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
+	"syscall"
 	"time"
 )
 
@@ -31,98 +46,596 @@ func main() {
 		return
 	}
 	// create elasticsearch client
-	es, err := elasticsearch.NewClient(elasticsearch.Config{
-		Addresses:           cfg.ES.Hosts,
-		DisableRetry:        true,
-		CompressRequestBody: true,
-	})
+	esConfig, err := newESConfig(cfg.ES)
+	if err != nil {
+		log.Printf("invalid elasticsearch config: %s", err)
+		return
+	}
+	es, err := elasticsearch.NewClient(esConfig)
 	if err != nil {
 		log.Printf("create elasticsearch client failed: %s", err)
 		return
 	}
 
+	// index templates
+	if cfg.ES.Templates.Dir != "" {
+		err = templates.Install(ctx, templates.Config{Client: es, Dir: cfg.ES.Templates.Dir})
+		if err != nil {
+			if cfg.ES.Templates.OnFailure != "warn" {
+				log.Printf("install index templates failed: %s", err)
+				return
+			}
+			log.Printf("install index templates failed, continue: %s", err)
+		}
+	}
+
+	kafkaTLS, err := newTLS(cfg.Kafka.TLS)
+	if err != nil {
+		log.Printf("invalid kafka tls: %s", err)
+		return
+	}
+	kafkaSASL, err := security.SASLConfig{
+		Mechanism:    cfg.Kafka.SASL.Mechanism,
+		Username:     cfg.Kafka.SASL.Username,
+		UsernameFile: cfg.Kafka.SASL.UsernameFile,
+		Password:     cfg.Kafka.SASL.Password,
+		PasswordFile: cfg.Kafka.SASL.PasswordFile,
+	}.New()
+	if err != nil {
+		log.Printf("invalid kafka sasl: %s", err)
+		return
+	}
+
+	// documents rejected by elasticsearch
+	var deadLetter *deadletter.Writer
+	if cfg.Kafka.DeadLetter.Topic != "" {
+		brokers := cfg.Kafka.DeadLetter.Brokers
+		if len(brokers) == 0 {
+			brokers = cfg.Kafka.Brokers
+		}
+		deadLetter, err = deadletter.NewWriter(deadletter.Config{
+			Brokers:      brokers,
+			Topic:        cfg.Kafka.DeadLetter.Topic,
+			ClientID:     cfg.Kafka.ClientID,
+			BatchTimeout: cfg.Kafka.DeadLetter.BatchTimeout,
+			WriteTimeout: cfg.Kafka.DeadLetter.WriteTimeout,
+			TLS:          kafkaTLS,
+			SASL:         kafkaSASL,
+		})
+		if err != nil {
+			log.Printf("create dead letter writer failed: %s", err)
+			return
+		}
+	}
+
+	// documents failed while elasticsearch is unavailable
+	var spool *indexer.Spool
+	if cfg.ES.Spool.Dir != "" {
+		spool, err = indexer.NewSpool(ctx, es, indexer.SpoolConfig{
+			Dir:            cfg.ES.Spool.Dir,
+			SegmentBytes:   cfg.ES.Spool.SegmentBytes,
+			MaxBytes:       cfg.ES.Spool.MaxBytes,
+			ReplayInterval: cfg.ES.Spool.ReplayInterval,
+			FlushBytes:     cfg.ES.FlushBytes,
+			DeadLetter:     deadLetter,
+		})
+		if err != nil {
+			log.Printf("create spool failed: %s", err)
+			return
+		}
+	}
+
+	var circuitBreaker *breaker.Breaker
+	if cfg.ES.Breaker.Enabled {
+		circuitBreaker = breaker.New(ctx, es, breaker.Config{
+			Interval:      cfg.ES.Breaker.Interval,
+			ProbeInterval: cfg.ES.Breaker.ProbeInterval,
+			Timeout:       cfg.ES.Breaker.Timeout,
+		})
+	}
+
+	retry := indexer.RetryConfig{
+		MaxAttempts:     cfg.ES.Retry.MaxAttempts,
+		InitialBackoff:  cfg.ES.Retry.InitialBackoff,
+		MaxBackoff:      cfg.ES.Retry.MaxBackoff,
+		MaxElapsed:      cfg.ES.Retry.MaxElapsed,
+		RetryableErrors: cfg.ES.Retry.RetryableErrors,
+	}
+
+	index := cfg.ES.Index
+	if index == "" {
+		index = data.TestIndex
+	}
+	fallbackIndex := cfg.ES.FallbackIndex
+	if fallbackIndex == "" {
+		fallbackIndex = data.TestIndex
+	}
+	template, err := indexer.ParseTemplate(index, fallbackIndex)
+	if err != nil {
+		log.Printf("parse index template failed: %s", err)
+		return
+	}
+
+	id := &indexer.IDStrategy{Type: cfg.ES.ID.Type, Field: cfg.ES.ID.Field, Fields: cfg.ES.ID.Fields}
+	if err = id.Validate(); err != nil {
+		log.Printf("invalid document id: %s", err)
+		return
+	}
+
+	metadata := &indexer.Metadata{
+		Field:    cfg.ES.Metadata.Field,
+		Headers:  cfg.ES.Metadata.Headers,
+		ClientID: cfg.Kafka.ClientID,
+	}
+
+	converters := make([]*charset.Converter, 0)
+	defaultConverter, err := newConverter("default", cfg.Charset, deadLetter)
+	if err != nil {
+		log.Printf("create charset converter failed: %s", err)
+		return
+	}
+	if defaultConverter != nil {
+		converters = append(converters, defaultConverter)
+	}
+
+	bucket, err := newBucket(cfg.ES.Bucket)
+	if err != nil {
+		log.Printf("invalid index bucket: %s", err)
+		return
+	}
+
+	decoders := make([]*codec.Decoder, 0)
+	defaultDecoder, err := newDecoder("default", cfg.Codec, deadLetter)
+	if err != nil {
+		log.Printf("create codec failed: %s", err)
+		return
+	}
+	if defaultDecoder != nil {
+		decoders = append(decoders, defaultDecoder)
+	}
+
+	chains := make([]*processor.Chain, 0)
+	defaultChain, err := newChain("default", cfg.Processors, deadLetter)
+	if err != nil {
+		log.Printf("create processors failed: %s", err)
+		return
+	}
+	if defaultChain != nil {
+		chains = append(chains, defaultChain)
+	}
+
+	routes := make([]*indexer.Route, 0, len(cfg.Routes))
+	for _, r := range cfg.Routes {
+		route, err := newRoute(r, fallbackIndex, id, metadata, bucket, defaultConverter, defaultDecoder, deadLetter)
+		if err != nil {
+			log.Printf("create route %s%s failed: %s", r.Topic, r.TopicPattern, err)
+			return
+		}
+		if route.Charset != nil && route.Charset != defaultConverter {
+			converters = append(converters, route.Charset)
+		}
+		if route.Codec != nil && route.Codec != defaultDecoder {
+			decoders = append(decoders, route.Codec)
+		}
+		if route.Processors != nil {
+			chains = append(chains, route.Processors)
+		}
+		routes = append(routes, route)
+	}
+
+	var adaptive *indexer.AdaptiveConfig
+	if cfg.ES.Adaptive.Enabled {
+		adaptive = &indexer.AdaptiveConfig{
+			MinFlushBytes:    cfg.ES.Adaptive.MinFlushBytes,
+			MaxFlushBytes:    cfg.ES.Adaptive.MaxFlushBytes,
+			FlushBytesStep:   cfg.ES.Adaptive.FlushBytesStep,
+			MinWorkers:       cfg.ES.Adaptive.MinWorkers,
+			MaxWorkers:       cfg.ES.Adaptive.MaxWorkers,
+			TargetLatency:    cfg.ES.Adaptive.TargetLatency,
+			TargetTook:       cfg.ES.Adaptive.TargetTook,
+			MaxRejectionRate: cfg.ES.Adaptive.MaxRejectionRate,
+			Decrease:         cfg.ES.Adaptive.Decrease,
+			Interval:         cfg.ES.Adaptive.Interval,
+		}
+	}
+
+	// end-to-end latency of the documents acknowledged by elasticsearch
+	latency := indexer.NewLatency(nil)
+
 	// elasticsearch multi indexer management
 	mgmt := indexer.NewIndexerMgmt(ctx, indexer.Config{
 		Client:        es,
+		Index:         template,
+		Routes:        routes,
+		DataStream:    cfg.ES.DataStream,
+		ID:            id,
+		Metadata:      metadata,
+		Bucket:        bucket,
+		Charset:       defaultConverter,
+		Codec:         defaultDecoder,
+		Processors:    defaultChain,
 		Workers:       cfg.ES.Workers,
 		FlushInterval: cfg.ES.FlushInterval,
 		Timeout:       cfg.ES.Timeout,
 		FlushBytes:    cfg.ES.FlushBytes,
 		MaxIdleCount:  cfg.ES.MaxIdleCount,
 		IdleInterval:  cfg.ES.IdleInterval,
+		DeadLetter:    deadLetter,
+		Retry:         retry,
+		Spool:         spool,
+		Adaptive:      adaptive,
+		Breaker:       circuitBreaker,
+		Latency:       latency,
 	})
-	blukIndexer := indexer.NewIndexer(indexer.BlukConfig{
-		Client:        es,
-		Workers:       cfg.ES.Workers,
-		FlushInterval: cfg.ES.FlushInterval,
-		Timeout:       cfg.ES.Timeout,
-		FlushBytes:    cfg.ES.FlushBytes,
-		MaxIdleCount:  cfg.ES.MaxIdleCount,
-		IdleInterval:  cfg.ES.IdleInterval,
-	})
+	// in-flight bytes shared by all consumers
+	var budget *flow.Budget
+	if cfg.Kafka.MaxInFlightBytes >= 0 {
+		maxInFlightBytes := cfg.Kafka.MaxInFlightBytes
+		if maxInFlightBytes == 0 {
+			maxInFlightBytes = 256 << 20
+		}
+		budget = flow.NewBudget(maxInFlightBytes)
+	}
+
 	groupConfig := group.Config{
 		Indexer:                mgmt,
-		BlukIndexer:            blukIndexer,
+		Budget:                 budget,
+		Breaker:                circuitBreaker,
 		Consumers:              cfg.Kafka.ConsumerThreads,
 		GroupID:                cfg.Kafka.GroupID,
 		GroupTopics:            cfg.Kafka.Topics,
 		Brokers:                cfg.Kafka.Brokers,
 		ClientID:               cfg.Kafka.ClientID,
+		TLS:                    kafkaTLS,
+		SASL:                   kafkaSASL,
 		QueueCapacity:          cfg.Kafka.QueueCapacity,
 		MinBytes:               cfg.Kafka.MinBytes,
 		MaxBytes:               cfg.Kafka.MaxBytes,
 		MaxWait:                cfg.Kafka.MaxWait,
 		CommitInterval:         cfg.Kafka.CommitInterval,
+		LagInterval:            cfg.Kafka.LagInterval,
 		PartitionWatchInterval: cfg.Kafka.PartitionWatchInterval,
 		WatchPartitionChanges:  cfg.Kafka.WatchPartitionChanges,
 		StartOffset:            cfg.Kafka.StartOffset,
 		ErrorLogger:            kafka.LoggerFunc(func(s string, i ...interface{}) { log.Printf(s, i...) }),
 	}
+	if len(converters) > 0 {
+		groupConfig.Charsets = func(topic string) *charset.Converter {
+			return mgmt.Route(topic).Charset
+		}
+	}
+	if len(decoders) > 0 {
+		groupConfig.Codecs = func(topic string) *codec.Decoder {
+			return mgmt.Route(topic).Codec
+		}
+	}
+	if len(chains) > 0 {
+		groupConfig.Processors = func(topic string) *processor.Chain {
+			return mgmt.Route(topic).Processors
+		}
+	}
 	consumerGroup, err := group.NewGroup(ctx, groupConfig)
 	if err != nil {
 		log.Printf("create consumer group failed: %s", err)
 		return
 	}
 
-	// clean all resources
-	clean := func() {
+	// clean all resources: stop fetching, flush the indexers and commit the acknowledged offsets
+	clean := func(ctx context.Context) error {
 		consumerGroup.Stop()
-		mgmt.Close()
+		err := mgmt.Close(ctx)
+		if deadLetter != nil {
+			_ = deadLetter.Close()
+		}
+		consumerGroup.Close(ctx)
+		if spool != nil {
+			_ = spool.Close()
+		}
+		return err
 	}
 
 	// register prometheus collector
 	reg := prometheus.NewRegistry()
-	reg.MustRegister(collectors.NewCounter(consumerGroup))
+	reg.MustRegister(collectors.NewReaderCollector(consumerGroup))
+	reg.MustRegister(collectors.NewWriterCollector(mgmt))
+	reg.MustRegister(collectors.NewLatencyCollector(latency))
+	if spool != nil {
+		reg.MustRegister(collectors.NewSpoolCollector(spool))
+	}
+	if budget != nil {
+		reg.MustRegister(collectors.NewFlowCollector(budget))
+	}
+	if len(converters) > 0 {
+		reg.MustRegister(collectors.NewCharsetCollector(converters))
+	}
+	if len(decoders) > 0 {
+		reg.MustRegister(collectors.NewCodecCollector(decoders))
+	}
+	if len(chains) > 0 {
+		reg.MustRegister(collectors.NewProcessorCollector(chains))
+	}
+	if adaptive != nil {
+		reg.MustRegister(collectors.NewAdaptiveCollector(mgmt))
+	}
+	if circuitBreaker != nil {
+		reg.MustRegister(collectors.NewBreakerCollector(circuitBreaker))
+	}
 
 	go func() {
 		http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
 		_ = http.ListenAndServe(":8080", nil)
 	}()
 
+	// 监听退出信号
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, os.Interrupt, syscall.SIGTERM)
+	sig := <-done
+	log.Printf("receive %s, service stop...", sig)
+	drainTimeout := cfg.DrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = 30 * time.Second
+	}
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer drainCancel()
+	drained := make(chan error, 1)
 	go func() {
-		ticker := time.NewTicker(time.Second * 10)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				for _, index := range mgmt.Indices() {
-					// todo indexerMgmt.Collector
-					exporter := collectors.NewWriterCollector(index, mgmt)
-					_ = reg.Register(exporter)
-				}
-			case <-ctx.Done():
-				return
-			}
-		}
+		drained <- clean(drainCtx)
 	}()
-
-	// 监听退出信号
-	done := make(chan os.Signal)
-	signal.Notify(done, os.Interrupt)
-	<-done
-	log.Println("receive interrupt, service stop...")
+	select {
+	case err = <-drained:
+	case <-drainCtx.Done():
+		err = drainCtx.Err()
+	case sig = <-done:
+		err = fmt.Errorf("receive %s", sig)
+	}
 	cancel()
-	clean()
+	if err != nil {
+		var inFlightBytes int64
+		if budget != nil {
+			inFlightBytes = budget.Stats().InFlightBytes
+		}
+		log.Printf("drain failed: %s, abandoned %d unacknowledged messages (%d bytes), they will be consumed again",
+			err, consumerGroup.Pending(), inFlightBytes)
+		drainCancel()
+		os.Exit(1)
+	}
 	log.Println("service stopped")
 
 }
+
+func newRoute(cfg config.Route, fallbackIndex string, id *indexer.IDStrategy, metadata *indexer.Metadata, bucket *indexer.Bucket,
+	converter *charset.Converter, decoder *codec.Decoder, deadLetter *deadletter.Writer) (*indexer.Route, error) {
+	if cfg.FallbackIndex != "" {
+		fallbackIndex = cfg.FallbackIndex
+	}
+	template, err := indexer.ParseTemplate(cfg.Index, fallbackIndex)
+	if err != nil {
+		return nil, fmt.Errorf("parse index template: %w", err)
+	}
+	route := &indexer.Route{
+		Topic:         cfg.Topic,
+		Index:         template,
+		Pipeline:      cfg.Pipeline,
+		Action:        cfg.Action,
+		DataStream:    cfg.DataStream,
+		ID:            id,
+		Metadata:      metadata,
+		Bucket:        bucket,
+		Charset:       converter,
+		Codec:         decoder,
+		Workers:       cfg.Workers,
+		FlushBytes:    cfg.FlushBytes,
+		FlushInterval: cfg.FlushInterval,
+	}
+	if cfg.ID != nil {
+		route.ID = &indexer.IDStrategy{Type: cfg.ID.Type, Field: cfg.ID.Field, Fields: cfg.ID.Fields}
+	}
+	if cfg.Bucket != nil {
+		if route.Bucket, err = newBucket(*cfg.Bucket); err != nil {
+			return nil, fmt.Errorf("create bucket: %w", err)
+		}
+	}
+	if cfg.Metadata != nil {
+		route.Metadata = &indexer.Metadata{Field: cfg.Metadata.Field, Headers: cfg.Metadata.Headers, ClientID: metadata.ClientID}
+	}
+	name := cfg.Topic
+	if name == "" {
+		name = cfg.TopicPattern
+	}
+	if cfg.Charset != nil {
+		if route.Charset, err = newConverter(name, *cfg.Charset, deadLetter); err != nil {
+			return nil, fmt.Errorf("create charset converter: %w", err)
+		}
+	}
+	if cfg.Codec != nil {
+		if route.Codec, err = newDecoder(name, *cfg.Codec, deadLetter); err != nil {
+			return nil, fmt.Errorf("create codec: %w", err)
+		}
+	}
+	if route.Processors, err = newChain(name, cfg.Processors, deadLetter); err != nil {
+		return nil, fmt.Errorf("create processors: %w", err)
+	}
+	if cfg.Topic == "" && cfg.TopicPattern != "" {
+		if route.TopicPattern, err = regexp.Compile(cfg.TopicPattern); err != nil {
+			return nil, fmt.Errorf("compile topic pattern: %w", err)
+		}
+	}
+	return route, route.Validate()
+}
+
+// newESConfig creates the client config, the tls and the proxy apply to either transport.
+func newESConfig(cfg config.ES) (elasticsearch.Config, error) {
+	esConfig := elasticsearch.Config{
+		Addresses:           cfg.Hosts,
+		Username:            cfg.Auth.Username,
+		DisableRetry:        true,
+		CompressRequestBody: true,
+	}
+	var err error
+	if esConfig.Password, err = security.Secret(cfg.Auth.Password, cfg.Auth.PasswordFile); err != nil {
+		return esConfig, fmt.Errorf("read password: %w", err)
+	}
+	if esConfig.APIKey, err = security.Secret(cfg.Auth.APIKey, cfg.Auth.APIKeyFile); err != nil {
+		return esConfig, fmt.Errorf("read api key: %w", err)
+	}
+	if esConfig.ServiceToken, err = security.Secret(cfg.Auth.ServiceToken, cfg.Auth.ServiceTokenFile); err != nil {
+		return esConfig, fmt.Errorf("read service token: %w", err)
+	}
+	bearer, err := security.Secret(cfg.Auth.BearerToken, cfg.Auth.BearerTokenFile)
+	if err != nil {
+		return esConfig, fmt.Errorf("read bearer token: %w", err)
+	}
+	// the client does not override an Authorization header, api keys and service tokens come first
+	if bearer != "" && esConfig.APIKey == "" && esConfig.ServiceToken == "" {
+		esConfig.Header = http.Header{"Authorization": []string{"Bearer " + bearer}}
+	}
+
+	tlsConfig, err := newTLS(cfg.TLS)
+	if err != nil {
+		return esConfig, fmt.Errorf("tls: %w", err)
+	}
+	switch cfg.Transport {
+	case "", "net/http", "http":
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		if cfg.Proxy != "" {
+			proxy, err := url.Parse(cfg.Proxy)
+			if err != nil {
+				return esConfig, fmt.Errorf("parse proxy: %w", err)
+			}
+			transport.Proxy = http.ProxyURL(proxy)
+		}
+		esConfig.Transport = transport
+	case "fasthttp":
+		esConfig.Transport, err = fasthttp.NewTransport(fasthttp.Config{
+			TLS:                 tlsConfig,
+			Proxy:               cfg.Proxy,
+			MaxConnsPerHost:     cfg.FastHTTP.MaxConnsPerHost,
+			ReadTimeout:         cfg.FastHTTP.ReadTimeout,
+			WriteTimeout:        cfg.FastHTTP.WriteTimeout,
+			MaxIdleConnDuration: cfg.FastHTTP.MaxIdleConnDuration,
+		})
+		if err != nil {
+			return esConfig, err
+		}
+	default:
+		return esConfig, fmt.Errorf("unknown transport %q", cfg.Transport)
+	}
+	return esConfig, nil
+}
+
+// newTLS creates the tls config, nil when tls is not enabled.
+func newTLS(cfg config.TLS) (*tls.Config, error) {
+	return security.TLSConfig{
+		Enabled:            cfg.Enabled,
+		CAFile:             cfg.CAFile,
+		CertFile:           cfg.CertFile,
+		KeyFile:            cfg.KeyFile,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		ServerName:         cfg.ServerName,
+		Fingerprint:        cfg.Fingerprint,
+	}.New()
+}
+
+// newBucket creates the time bucket of the indices, nil when no interval is configured.
+func newBucket(cfg config.Bucket) (*indexer.Bucket, error) {
+	if cfg.Interval == "" {
+		return nil, nil
+	}
+	bucket := &indexer.Bucket{
+		Interval:      cfg.Interval,
+		Field:         cfg.Field,
+		Layout:        cfg.Layout,
+		Fallback:      cfg.Fallback,
+		MaxPast:       cfg.MaxPast,
+		MaxFuture:     cfg.MaxFuture,
+		OutOfRange:    cfg.OutOfRange,
+		CatchAllIndex: cfg.CatchAllIndex,
+	}
+	if cfg.Timezone != "" {
+		location, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		bucket.Location = location
+	}
+	return bucket, bucket.Validate()
+}
+
+// newConverter creates the charset converter, nil for utf-8 messages without invalid utf-8 policy.
+func newConverter(name string, cfg config.Charset, deadLetter *deadletter.Writer) (*charset.Converter, error) {
+	if cfg.Charset == "" && cfg.Invalid == "" {
+		return nil, nil
+	}
+	return charset.New(name, charset.Config{
+		Charset:    cfg.Charset,
+		Fields:     cfg.Fields,
+		Invalid:    cfg.Invalid,
+		DeadLetter: deadLetter,
+	})
+}
+
+// newDecoder creates the decoder of the codec, nil for json messages.
+func newDecoder(name string, cfg config.Codec, deadLetter *deadletter.Writer) (*codec.Decoder, error) {
+	if cfg.Type == "" || cfg.Type == codec.TypeJSON {
+		return nil, nil
+	}
+	return codec.New(name, codec.Config{
+		Type:      cfg.Type,
+		Field:     cfg.Field,
+		Columns:   cfg.Columns,
+		Separator: cfg.Separator,
+		SchemaRegistry: codec.RegistryConfig{
+			URL:      cfg.SchemaRegistry.URL,
+			Username: cfg.SchemaRegistry.Username,
+			Password: cfg.SchemaRegistry.Password,
+			Timeout:  cfg.SchemaRegistry.Timeout,
+		},
+		DescriptorSet: cfg.DescriptorSet,
+		Message:       cfg.Message,
+		DeadLetter:    deadLetter,
+	})
+}
+
+// newChain creates the processor chain, nil when no processor is configured.
+func newChain(name string, processors []config.Processor, deadLetter *deadletter.Writer) (*processor.Chain, error) {
+	if len(processors) == 0 {
+		return nil, nil
+	}
+	configs := make([]processor.Config, 0, len(processors))
+	for _, p := range processors {
+		cfg := processor.Config{
+			Type:   p.Type,
+			Field:  p.Field,
+			Fields: p.Fields,
+			Target: p.Target,
+			From:   p.From,
+			Value:  p.Value,
+			To:     p.To,
+
+			Separator:   p.Separator,
+			Columns:     p.Columns,
+			NullValue:   p.NullValue,
+			JSONColumns: p.JSONColumns,
+
+			Detectors: p.Detectors,
+			Mode:      p.Mode,
+			Mask:      p.Mask,
+			HashKey:   p.HashKey,
+		}
+		for _, rule := range p.Rules {
+			cfg.Rules = append(cfg.Rules, processor.RuleConfig{Name: rule.Name, Pattern: rule.Pattern})
+		}
+		if p.If != nil {
+			cfg.If = &processor.ConditionConfig{
+				Field:     p.If.Field,
+				Equals:    p.If.Equals,
+				NotEquals: p.If.NotEquals,
+				Exists:    p.If.Exists,
+				Matches:   p.If.Matches,
+			}
+		}
+		configs = append(configs, cfg)
+	}
+	return processor.NewChainConfig(name, configs, deadLetter)
+}
@@ -0,0 +1,202 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Condition matches events on a field, all the set criteria must match.
+type Condition struct {
+	Field     string
+	Equals    interface{}    // compared as text
+	NotEquals interface{}    // compared as text
+	Exists    *bool          // the field is present
+	Matches   *regexp.Regexp // the text of the field
+}
+
+func (c *Condition) Match(event *Event) bool {
+	value, ok := event.Get(c.Field)
+	if c.Exists != nil && *c.Exists != ok {
+		return false
+	}
+	if c.Equals != nil && (!ok || text(value) != text(c.Equals)) {
+		return false
+	}
+	if c.NotEquals != nil && ok && text(value) == text(c.NotEquals) {
+		return false
+	}
+	if c.Matches != nil && (!ok || !c.Matches.MatchString(text(value))) {
+		return false
+	}
+	return true
+}
+
+// text returns the text of a scalar, or the json of an object or array.
+func text(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case nil:
+		return ""
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	return fmt.Sprint(value)
+}
+
+// Set sets a field to a value, or to the value of another field.
+type Set struct {
+	Field string
+	Value interface{}
+	From  string
+}
+
+func (p *Set) Process(event *Event) ([]*Event, error) {
+	value := p.Value
+	if p.From != "" {
+		v, ok := event.Get(p.From)
+		if !ok {
+			return []*Event{event}, nil
+		}
+		value = v
+	}
+	if err := event.Put(p.Field, value); err != nil {
+		return nil, err
+	}
+	return []*Event{event}, nil
+}
+
+// Rename moves a field.
+type Rename struct {
+	Field  string
+	Target string
+}
+
+func (p *Rename) Process(event *Event) ([]*Event, error) {
+	value, ok := event.Get(p.Field)
+	if !ok {
+		return []*Event{event}, nil
+	}
+	if err := event.Put(p.Target, value); err != nil {
+		return nil, err
+	}
+	event.Delete(p.Field)
+	return []*Event{event}, nil
+}
+
+// Copy copies a field.
+type Copy struct {
+	Field  string
+	Target string
+}
+
+func (p *Copy) Process(event *Event) ([]*Event, error) {
+	value, ok := event.Get(p.Field)
+	if !ok {
+		return []*Event{event}, nil
+	}
+	if err := event.Put(p.Target, clone(value)); err != nil {
+		return nil, err
+	}
+	return []*Event{event}, nil
+}
+
+// Remove removes fields.
+type Remove struct {
+	Fields []string
+}
+
+func (p *Remove) Process(event *Event) ([]*Event, error) {
+	for _, field := range p.Fields {
+		event.Delete(field)
+	}
+	return []*Event{event}, nil
+}
+
+// conversion types
+const (
+	ToInt    = "int"
+	ToFloat  = "float"
+	ToString = "string"
+	ToBool   = "bool"
+)
+
+// Convert converts the type of a field.
+type Convert struct {
+	Field string
+	To    string
+}
+
+func (p *Convert) Process(event *Event) ([]*Event, error) {
+	value, ok := event.Get(p.Field)
+	if !ok || value == nil {
+		return []*Event{event}, nil
+	}
+	converted, err := convert(value, p.To)
+	if err != nil {
+		return nil, fmt.Errorf("convert %s: %w", p.Field, err)
+	}
+	if err = event.Put(p.Field, converted); err != nil {
+		return nil, err
+	}
+	return []*Event{event}, nil
+}
+
+func convert(value interface{}, to string) (interface{}, error) {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		return nil, fmt.Errorf("can not convert %s to %s", reflect.TypeOf(value), to)
+	}
+	s := strings.TrimSpace(text(value))
+	switch to {
+	case ToString:
+		return text(value), nil
+	case ToInt:
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+		if b, err := strconv.ParseBool(s); err == nil {
+			if b {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an int", s)
+		}
+		return int64(f), nil
+	case ToFloat:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a float", s)
+		}
+		return f, nil
+	case ToBool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a bool", s)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown type %q", to)
+}
+
+// Drop drops the events matching the condition.
+type Drop struct {
+	If *Condition
+}
+
+func (p *Drop) Process(event *Event) ([]*Event, error) {
+	if p.If.Match(event) {
+		return nil, nil
+	}
+	return []*Event{event}, nil
+}
@@ -0,0 +1,233 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/ydgo/k2es/deadletter"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrorType is the dead letter error type of the messages a redact processor could not run on.
+const ErrorType = "k2es_redact_exception"
+
+// Chain runs processors in order, an event a processor fails on continues
+// down the chain as it was before that processor. Redact fails closed: the message of an
+// event it fails on, or of a message that is not a json document, is not indexed but sent
+// to the dead letter topic, dropped when there is none.
+type Chain struct {
+	name       string
+	stages     []*stage
+	deadLetter *deadletter.Writer
+}
+
+type stage struct {
+	name       string
+	processor  Processor
+	failClosed bool // redact
+	in         atomic.Uint64
+	out        atomic.Uint64
+	dropped    atomic.Uint64
+	errored    atomic.Uint64
+	withheld   atomic.Uint64
+}
+
+// Stats are the event counters of a processor of a chain.
+type Stats struct {
+	Chain     string
+	Processor string
+	In        uint64
+	Out       uint64
+	Dropped   uint64
+	Errored   uint64
+	Withheld  uint64 // messages not indexed as the processor could not run, a redact one
+}
+
+// Counter is implemented by the processors counting what they matched, such as the rules of redact.
+type Counter interface {
+	Counts() map[string]uint64
+}
+
+// Count is a named counter of a processor of a chain.
+type Count struct {
+	Chain     string
+	Processor string
+	Name      string
+	Value     uint64
+}
+
+// NewChain creates a chain, names identify the processors in the stats.
+func NewChain(name string, names []string, processors []Processor) *Chain {
+	chain := &Chain{name: name}
+	for i, p := range processors {
+		s := &stage{name: names[i], processor: p}
+		if cond, ok := p.(*conditional); ok {
+			p = cond.processor
+		}
+		_, s.failClosed = p.(*Redact)
+		chain.stages = append(chain.stages, s)
+	}
+	return chain
+}
+
+func (c *Chain) Name() string {
+	return c.name
+}
+
+// Run returns the events to index in place of event, an error when a redact processor failed
+// on one of them so that none is indexed.
+func (c *Chain) Run(event *Event) ([]*Event, error) {
+	events := []*Event{event}
+	for _, s := range c.stages {
+		next := make([]*Event, 0, len(events))
+		for _, e := range events {
+			s.in.Add(1)
+			out, err := s.processor.Process(e)
+			if err != nil {
+				s.errored.Add(1)
+				log.Printf("processor %s/%s: %s", c.name, s.name, err)
+				if s.failClosed {
+					s.withheld.Add(1)
+					return nil, fmt.Errorf("processor %s/%s: %w", c.name, s.name, err)
+				}
+				next = append(next, e)
+				continue
+			}
+			if len(out) == 0 {
+				s.dropped.Add(1)
+			}
+			s.out.Add(uint64(len(out)))
+			next = append(next, out...)
+		}
+		if events = next; len(events) == 0 {
+			break
+		}
+	}
+	return events, nil
+}
+
+// undecoded withholds a message that is not a json document when the chain redacts, it is
+// counted by the first redact processor.
+func (c *Chain) undecoded(err error) error {
+	for _, s := range c.stages {
+		if s.failClosed {
+			s.in.Add(1)
+			s.errored.Add(1)
+			s.withheld.Add(1)
+			log.Printf("processor %s/%s: not a json document: %s", c.name, s.name, err)
+			return fmt.Errorf("processor %s/%s: not a json document: %w", c.name, s.name, err)
+		}
+	}
+	return nil
+}
+
+// withhold sends msg to the dead letter topic instead of indexing it, or drops it.
+func (c *Chain) withhold(ctx context.Context, msg kafka.Message, ack func(error), err error) {
+	if c.deadLetter == nil {
+		ack(nil)
+		return
+	}
+	c.deadLetter.Send(ctx, msg, deadletter.Rejection{ErrorType: ErrorType, ErrorReason: err.Error()}, ack)
+}
+
+func (c *Chain) Stats() []Stats {
+	stats := make([]Stats, 0, len(c.stages))
+	for _, s := range c.stages {
+		stats = append(stats, Stats{
+			Chain:     c.name,
+			Processor: s.name,
+			In:        s.in.Load(),
+			Out:       s.out.Load(),
+			Dropped:   s.dropped.Load(),
+			Errored:   s.errored.Load(),
+			Withheld:  s.withheld.Load(),
+		})
+	}
+	return stats
+}
+
+func (c *Chain) Counts() []Count {
+	counts := make([]Count, 0)
+	for _, s := range c.stages {
+		p := s.processor
+		if cond, ok := p.(*conditional); ok {
+			p = cond.processor
+		}
+		counter, ok := p.(Counter)
+		if !ok {
+			continue
+		}
+		for name, value := range counter.Counts() {
+			counts = append(counts, Count{Chain: c.name, Processor: s.name, Name: name, Value: value})
+		}
+	}
+	return counts
+}
+
+// Handler runs the chain of the message topic before handing the events to next.
+type Handler struct {
+	chains func(topic string) *Chain
+	next   func(ctx context.Context, msg kafka.Message, ack func(error)) error
+}
+
+// NewHandler creates a handler, chains returns nil for topics without processors.
+func NewHandler(chains func(topic string) *Chain, next func(ctx context.Context, msg kafka.Message, ack func(error)) error) *Handler {
+	return &Handler{chains: chains, next: next}
+}
+
+// Handle acknowledges msg once every event it turned into was acknowledged.
+func (h *Handler) Handle(ctx context.Context, msg kafka.Message, ack func(error)) error {
+	chain := h.chains(msg.Topic)
+	if chain == nil || len(chain.stages) == 0 {
+		return h.next(ctx, msg, ack)
+	}
+	event, err := Decode(msg)
+	if err != nil {
+		if err = chain.undecoded(err); err != nil {
+			chain.withhold(ctx, msg, ack, err)
+			return nil
+		}
+		// not a json document, indexed as it is
+		return h.next(ctx, msg, ack)
+	}
+	events, err := chain.Run(event)
+	if err != nil {
+		chain.withhold(ctx, msg, ack, err)
+		return nil
+	}
+	if len(events) == 0 {
+		ack(nil)
+		return nil
+	}
+	acks := join(len(events), ack)
+	for _, e := range events {
+		out := e.Message
+		if out.Value, err = e.Encode(); err != nil {
+			acks(fmt.Errorf("chain %s: %w", chain.name, err))
+			continue
+		}
+		if err = h.next(ctx, out, acks); err != nil {
+			acks(err)
+		}
+	}
+	return nil
+}
+
+// join returns an acknowledgement function to call n times, ack is called with the first error
+// once all calls were made.
+func join(n int, ack func(error)) func(error) {
+	var mux sync.Mutex
+	var first error
+	return func(err error) {
+		mux.Lock()
+		defer mux.Unlock()
+		if err != nil && first == nil {
+			first = err
+		}
+		if n--; n == 0 {
+			ack(first)
+		}
+	}
+}
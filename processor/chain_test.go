@@ -0,0 +1,69 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"testing"
+)
+
+type failing struct{}
+
+func (failing) Process(*Event) ([]*Event, error) {
+	return nil, errors.New("failed")
+}
+
+func TestHandlerWithheld(t *testing.T) {
+	redact, err := NewChainConfig("logs", []Config{{Type: TypeRedact, Field: "message", Detectors: []string{"phone"}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a redact processor failing on the event, it can not on a decoded document
+	failed := NewChain("logs", []string{"00-redact"}, []Processor{failing{}})
+	failed.stages[0].failClosed = true
+	convert, err := NewChainConfig("logs", []Config{{Type: TypeConvert, Field: "n", To: "int"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		chain    *Chain
+		value    string
+		next     string // value handed to next, none when empty
+		withheld uint64
+	}{
+		{"redacted", redact, `{"message":"call 13800138000"}`, `{"message":"call ******"}`, 0},
+		{"not json", redact, `call 13800138000`, "", 1},
+		{"redact failed", failed, `{"message":"a"}`, "", 1},
+		{"not json without redact", convert, `n=1`, `n=1`, 0},
+		{"convert failed", convert, `{"n":"a"}`, `{"n":"a"}`, 0},
+	}
+	for _, tt := range tests {
+		var next []string
+		handler := NewHandler(func(string) *Chain { return tt.chain }, func(ctx context.Context, msg kafka.Message, ack func(error)) error {
+			next = append(next, string(msg.Value))
+			ack(nil)
+			return nil
+		})
+		acked := 0
+		before := tt.chain.Stats()[0].Withheld
+		err := handler.Handle(context.Background(), kafka.Message{Topic: "logs", Value: []byte(tt.value)}, func(err error) {
+			if err != nil {
+				t.Errorf("%s: ack %s", tt.name, err)
+			}
+			acked++
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if acked != 1 {
+			t.Errorf("%s: acked %d times", tt.name, acked)
+		}
+		if tt.next == "" && len(next) != 0 || tt.next != "" && (len(next) != 1 || next[0] != tt.next) {
+			t.Errorf("%s: next got %q, want %q", tt.name, next, tt.next)
+		}
+		if withheld := tt.chain.Stats()[0].Withheld - before; withheld != tt.withheld {
+			t.Errorf("%s: withheld = %d, want %d", tt.name, withheld, tt.withheld)
+		}
+	}
+}
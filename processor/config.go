@@ -0,0 +1,225 @@
+package processor
+
+import (
+	"fmt"
+	"github.com/ydgo/k2es/deadletter"
+	"regexp"
+)
+
+// processor types
+const (
+	TypeSet     = "set"
+	TypeRename  = "rename"
+	TypeCopy    = "copy"
+	TypeRemove  = "remove"
+	TypeConvert = "convert"
+	TypeDrop    = "drop"
+	TypeDissect = "dissect"
+	TypeRedact  = "redact"
+)
+
+// Config declares a processor, the fields used depend on the type.
+type Config struct {
+	Type   string
+	Field  string
+	Fields []string    // remove
+	Target string      // rename, copy, dissect
+	From   string      // set
+	Value  interface{} // set
+	To     string      // convert: int, float, string, bool
+	If     *ConditionConfig
+
+	// dissect
+	Separator   string // Default: |
+	Columns     []string
+	NullValue   string
+	JSONColumns []string
+
+	// redact
+	Detectors []string // names of Detectors
+	Rules     []RuleConfig
+	Mode      string // mask, hash Default: mask
+	Mask      string // Default: ******
+	HashKey   string
+}
+
+type RuleConfig struct {
+	Name    string
+	Pattern string
+}
+
+type ConditionConfig struct {
+	Field     string
+	Equals    interface{}
+	NotEquals interface{}
+	Exists    *bool
+	Matches   string
+}
+
+// NewChainConfig creates the chain of the processors declared in order, the messages a redact
+// processor can not run on are sent to deadLetter, dropped when nil.
+func NewChainConfig(name string, configs []Config, deadLetter *deadletter.Writer) (*Chain, error) {
+	names := make([]string, 0, len(configs))
+	processors := make([]Processor, 0, len(configs))
+	for i, cfg := range configs {
+		p, err := New(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("processor %d %s: %w", i, cfg.Type, err)
+		}
+		names = append(names, fmt.Sprintf("%02d-%s", i, cfg.Type))
+		processors = append(processors, p)
+	}
+	chain := NewChain(name, names, processors)
+	chain.deadLetter = deadLetter
+	return chain, nil
+}
+
+// New creates a processor, a processor with a condition only processes the matching events.
+func New(cfg Config) (Processor, error) {
+	var condition *Condition
+	if cfg.If != nil {
+		if cfg.If.Field == "" {
+			return nil, fmt.Errorf("condition field is required")
+		}
+		condition = &Condition{
+			Field:     cfg.If.Field,
+			Equals:    cfg.If.Equals,
+			NotEquals: cfg.If.NotEquals,
+			Exists:    cfg.If.Exists,
+		}
+		if cfg.If.Matches != "" {
+			matches, err := regexp.Compile(cfg.If.Matches)
+			if err != nil {
+				return nil, fmt.Errorf("condition: %w", err)
+			}
+			condition.Matches = matches
+		}
+	}
+
+	var p Processor
+	switch cfg.Type {
+	case TypeSet:
+		if cfg.Field == "" {
+			return nil, fmt.Errorf("field is required")
+		}
+		p = &Set{Field: cfg.Field, Value: cfg.Value, From: cfg.From}
+	case TypeRename, TypeCopy:
+		if cfg.Field == "" || cfg.Target == "" {
+			return nil, fmt.Errorf("field and target are required")
+		}
+		if cfg.Type == TypeRename {
+			p = &Rename{Field: cfg.Field, Target: cfg.Target}
+		} else {
+			p = &Copy{Field: cfg.Field, Target: cfg.Target}
+		}
+	case TypeRemove:
+		fields := cfg.Fields
+		if cfg.Field != "" {
+			fields = append(fields, cfg.Field)
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("fields are required")
+		}
+		p = &Remove{Fields: fields}
+	case TypeConvert:
+		if cfg.Field == "" {
+			return nil, fmt.Errorf("field is required")
+		}
+		switch cfg.To {
+		case ToInt, ToFloat, ToString, ToBool:
+		default:
+			return nil, fmt.Errorf("unknown conversion type %q", cfg.To)
+		}
+		p = &Convert{Field: cfg.Field, To: cfg.To}
+	case TypeDissect:
+		if cfg.Field == "" || len(cfg.Columns) == 0 {
+			return nil, fmt.Errorf("field and columns are required")
+		}
+		dissect := &Dissect{
+			Field:       cfg.Field,
+			Separator:   cfg.Separator,
+			Columns:     cfg.Columns,
+			Target:      cfg.Target,
+			NullValue:   cfg.NullValue,
+			JSONColumns: make(map[string]struct{}),
+		}
+		if dissect.Separator == "" {
+			dissect.Separator = "|"
+		}
+		for _, column := range cfg.JSONColumns {
+			dissect.JSONColumns[column] = struct{}{}
+		}
+		p = dissect
+	case TypeRedact:
+		redact, err := newRedact(cfg)
+		if err != nil {
+			return nil, err
+		}
+		p = redact
+	case TypeDrop:
+		if condition == nil {
+			return nil, fmt.Errorf("condition is required")
+		}
+		return &Drop{If: condition}, nil
+	default:
+		return nil, fmt.Errorf("unknown processor type %q", cfg.Type)
+	}
+	if condition != nil {
+		return &conditional{condition: condition, processor: p}, nil
+	}
+	return p, nil
+}
+
+type conditional struct {
+	condition *Condition
+	processor Processor
+}
+
+func (c *conditional) Process(event *Event) ([]*Event, error) {
+	if !c.condition.Match(event) {
+		return []*Event{event}, nil
+	}
+	return c.processor.Process(event)
+}
+
+func newRedact(cfg Config) (*Redact, error) {
+	fields := cfg.Fields
+	if cfg.Field != "" {
+		fields = append(fields, cfg.Field)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("fields are required")
+	}
+	redact := &Redact{Fields: fields, Mode: cfg.Mode, Mask: cfg.Mask, HashKey: []byte(cfg.HashKey)}
+	switch redact.Mode {
+	case "":
+		redact.Mode = RedactMask
+	case RedactMask, RedactHash:
+	default:
+		return nil, fmt.Errorf("unknown mode %q", cfg.Mode)
+	}
+	if redact.Mask == "" {
+		redact.Mask = "******"
+	}
+	for _, name := range cfg.Detectors {
+		pattern, ok := Detectors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown detector %q", name)
+		}
+		redact.Rules = append(redact.Rules, &RedactRule{Name: name, Pattern: regexp.MustCompile(pattern), Bounded: bounded[name]})
+	}
+	for i, rule := range cfg.Rules {
+		if rule.Name == "" || rule.Pattern == "" {
+			return nil, fmt.Errorf("rule %d: name and pattern are required", i)
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+		redact.Rules = append(redact.Rules, &RedactRule{Name: rule.Name, Pattern: pattern})
+	}
+	if len(redact.Rules) == 0 {
+		return nil, fmt.Errorf("detectors or rules are required")
+	}
+	return redact, nil
+}
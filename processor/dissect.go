@@ -0,0 +1,69 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Dissect splits a text field by a separator into positional columns, such as the | delimited
+// _raw records, so that they are parsed by k2es instead of an ingest pipeline.
+type Dissect struct {
+	Field       string
+	Separator   string
+	Columns     []string            // column names in order, an empty name or _ skips the column
+	Target      string              // object the columns are put in, "" puts them at the root
+	NullValue   string              // placeholder of a missing value, the column is skipped
+	JSONColumns map[string]struct{} // columns holding a json document, parsed into objects
+}
+
+func (p *Dissect) Process(event *Event) ([]*Event, error) {
+	value, ok := event.Get(p.Field)
+	if !ok {
+		return []*Event{event}, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("dissect %s: not a string", p.Field)
+	}
+	values := strings.Split(s, p.Separator)
+	if len(values) > len(p.Columns) {
+		return nil, fmt.Errorf("dissect %s: %d values for %d columns", p.Field, len(values), len(p.Columns))
+	}
+
+	columns := make(map[string]interface{}, len(values))
+	for i, v := range values {
+		name := p.Columns[i]
+		if name == "" || name == "_" || v == p.NullValue && p.NullValue != "" {
+			continue
+		}
+		if _, ok := p.JSONColumns[name]; ok {
+			columns[name] = parseJSON(v)
+			continue
+		}
+		columns[name] = v
+	}
+
+	// columns are only put once the whole record was parsed
+	for name, v := range columns {
+		if p.Target != "" {
+			name = p.Target + "." + name
+		}
+		if err := event.Put(name, v); err != nil {
+			return nil, fmt.Errorf("dissect %s: %w", p.Field, err)
+		}
+	}
+	return []*Event{event}, nil
+}
+
+// parseJSON decodes a json value, the text is kept when it is not json.
+func parseJSON(text string) interface{} {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(text)))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil || decoder.More() {
+		return text
+	}
+	return value
+}
@@ -0,0 +1,117 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"strings"
+)
+
+// Processor shapes the documents between kafka and elasticsearch. It returns the events to
+// index in place of event: none drops it, several split it.
+type Processor interface {
+	Process(event *Event) ([]*Event, error)
+}
+
+// Event is a decoded kafka message, json numbers are kept as json.Number.
+type Event struct {
+	Message kafka.Message
+	Fields  map[string]interface{}
+}
+
+// Decode decodes the json document of msg.
+func Decode(msg kafka.Message) (*Event, error) {
+	decoder := json.NewDecoder(bytes.NewReader(msg.Value))
+	decoder.UseNumber()
+	fields := make(map[string]interface{})
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	return &Event{Message: msg, Fields: fields}, nil
+}
+
+// Encode returns the json document of the event.
+func (e *Event) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(e.Fields); err != nil {
+		return nil, fmt.Errorf("encode: %w", err)
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// Clone returns a deep copy of the event.
+func (e *Event) Clone() *Event {
+	return &Event{Message: e.Message, Fields: clone(e.Fields).(map[string]interface{})}
+}
+
+func clone(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[key] = clone(value)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, value := range v {
+			s[i] = clone(value)
+		}
+		return s
+	}
+	return value
+}
+
+// Get returns the value of a field, nested fields are separated by dots.
+func (e *Event) Get(field string) (interface{}, bool) {
+	var value interface{} = e.Fields
+	for _, key := range strings.Split(field, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// Put sets the value of a field, creating the missing parent objects.
+func (e *Event) Put(field string, value interface{}) error {
+	keys := strings.Split(field, ".")
+	m := e.Fields
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := m[key]
+		if !ok {
+			child = make(map[string]interface{})
+			m[key] = child
+		}
+		if m, ok = child.(map[string]interface{}); !ok {
+			return fmt.Errorf("field %s is not an object", key)
+		}
+	}
+	m[keys[len(keys)-1]] = value
+	return nil
+}
+
+// Delete removes a field, it returns false when the field is missing.
+func (e *Event) Delete(field string) bool {
+	keys := strings.Split(field, ".")
+	m := e.Fields
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := m[key].(map[string]interface{})
+		if !ok {
+			return false
+		}
+		m = child
+	}
+	if _, ok := m[keys[len(keys)-1]]; !ok {
+		return false
+	}
+	delete(m, keys[len(keys)-1])
+	return true
+}
@@ -0,0 +1,180 @@
+package processor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// redaction modes
+const (
+	RedactMask = "mask"
+	RedactHash = "hash"
+)
+
+// Detectors are the built-in redaction rules, the first submatch of a rule is redacted when it
+// has one, the whole match otherwise.
+var Detectors = map[string]string{
+	// password=, pwd: and *_pass: key-values, a comma is part of the value unless followed by a space
+	"password": `(?i)(?:password|passwd|pwd|pass)\s*[=:]\s*((?:[^\s,;&|"'}]|,[^\s&|"'}])+)`,
+	"token":    `(?i)[?&](?:access_)?token=([^&#\s"'|]+)`,
+	"phone":    `(?:\+?86[- ]?)?1[3-9]\d{9}`, // not touching a letter or a digit, see bounded
+	"email":    `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	"ipv4":     `\b(?:(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\.){3}(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\b`,
+}
+
+// bounded are the detectors whose matches must not be preceded or followed by an ascii letter
+// or digit. It is checked around the match rather than by the pattern, as RE2 has no
+// lookaround and a delimiter consumed by a match would hide the next adjacent one.
+var bounded = map[string]bool{"phone": true}
+
+// RedactRule is a named pattern of the text to redact.
+type RedactRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Bounded bool // the matches must not touch an ascii letter or digit
+	matches atomic.Uint64
+}
+
+// Redact masks or hashes the text matching the rules in the string values of fields, objects
+// and arrays included.
+type Redact struct {
+	Fields  []string
+	Rules   []*RedactRule
+	Mode    string // mask, hash
+	Mask    string // replacement of the mask mode
+	HashKey []byte // key of the hmac of the hash mode, plain sha256 when empty
+}
+
+func (p *Redact) Process(event *Event) ([]*Event, error) {
+	for _, field := range p.Fields {
+		value, ok := event.Get(field)
+		if !ok {
+			continue
+		}
+		if redacted, changed := p.redactValue(value); changed {
+			if err := event.Put(field, redacted); err != nil {
+				return nil, fmt.Errorf("redact %s: %w", field, err)
+			}
+		}
+	}
+	return []*Event{event}, nil
+}
+
+// Counts returns the number of matches of each rule.
+func (p *Redact) Counts() map[string]uint64 {
+	counts := make(map[string]uint64, len(p.Rules))
+	for _, rule := range p.Rules {
+		counts[rule.Name] += rule.matches.Load()
+	}
+	return counts
+}
+
+func (p *Redact) redactValue(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case string:
+		s := v
+		for _, rule := range p.Rules {
+			s = p.redact(rule, s)
+		}
+		return s, s != v
+	case map[string]interface{}:
+		changed := false
+		for key, item := range v {
+			if redacted, ok := p.redactValue(item); ok {
+				v[key] = redacted
+				changed = true
+			}
+		}
+		return v, changed
+	case []interface{}:
+		changed := false
+		for i, item := range v {
+			if redacted, ok := p.redactValue(item); ok {
+				v[i] = redacted
+				changed = true
+			}
+		}
+		return v, changed
+	}
+	return value, false
+}
+
+func (p *Redact) redact(rule *RedactRule, s string) string {
+	matches := rule.find(s)
+	if len(matches) == 0 {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		b.WriteString(s[last:start])
+		b.WriteString(p.replacement(s[start:end]))
+		last = end
+	}
+	b.WriteString(s[last:])
+	rule.matches.Add(uint64(len(matches)))
+	return b.String()
+}
+
+// find returns the bounds of the text to redact of each match, the first submatch when the
+// pattern has one.
+func (rule *RedactRule) find(s string) [][2]int {
+	found := make([][2]int, 0)
+	for pos := 0; pos <= len(s); {
+		m := rule.Pattern.FindStringSubmatchIndex(s[pos:])
+		if m == nil {
+			break
+		}
+		start, end := pos+m[0], pos+m[1]
+		if rule.Bounded && (alnumAt(s, start-1) || alnumAt(s, end)) {
+			// a match may start inside the rejected one, such as 13800138000 in 8613800138000
+			_, size := utf8.DecodeRuneInString(s[start:])
+			pos = start + size
+			continue
+		}
+		if len(m) >= 4 && m[2] >= 0 {
+			found = append(found, [2]int{pos + m[2], pos + m[3]})
+		} else {
+			found = append(found, [2]int{start, end})
+		}
+		if pos = end; end == start {
+			_, size := utf8.DecodeRuneInString(s[end:])
+			pos += size
+			if size == 0 {
+				break
+			}
+		}
+	}
+	return found
+}
+
+// alnumAt reports whether the byte at i is an ascii letter or digit, the bytes of the other
+// utf-8 characters are not.
+func alnumAt(s string, i int) bool {
+	if i < 0 || i >= len(s) {
+		return false
+	}
+	c := s[i]
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func (p *Redact) replacement(text string) string {
+	if p.Mode != RedactHash {
+		return p.Mask
+	}
+	if len(p.HashKey) == 0 {
+		sum := sha256.Sum256([]byte(text))
+		return hex.EncodeToString(sum[:16])
+	}
+	mac := hmac.New(sha256.New, p.HashKey)
+	mac.Write([]byte(text))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
@@ -0,0 +1,71 @@
+package processor
+
+import (
+	"testing"
+)
+
+func TestDetectors(t *testing.T) {
+	tests := []struct {
+		detector string
+		in       string
+		want     string
+		matches  uint64
+	}{
+		{"password", "login password=s3cr,et ok", "login password=*** ok", 1},
+		{"password", "pwd: abc, user: bob", "pwd: ***, user: bob", 1},
+		{"password", `{"pass":"x"}`, `{"pass":"x"}`, 0},
+		{"token", "GET /a?access_token=abc&b=1", "GET /a?access_token=***&b=1", 1},
+		{"token", "/a?token=x&token=y", "/a?token=***&token=***", 2},
+		{"token", "token=abc", "token=abc", 0},
+		{"phone", "call 13800138000", "call ***", 1},
+		{"phone", "+86 13800138000.", "***.", 1},
+		{"phone", "13800138000,13900139000", "***,***", 2},
+		{"phone", "a 13800138000 13900139000 b", "a *** *** b", 2},
+		{"phone", "电话13800138000", "电话***", 1},
+		{"phone", "id 813800138000", "id 813800138000", 0},
+		{"phone", "x13800138000", "x13800138000", 0},
+		{"phone", "138001380001", "138001380001", 0},
+		{"phone", "12800138000", "12800138000", 0},
+		{"email", "to a.b+c@example.com, d@x.org", "to ***, ***", 2},
+		{"email", "a@localhost", "a@localhost", 0},
+		{"ipv4", "from 10.0.0.1:8080 to 255.255.255.255", "from ***:8080 to ***", 2},
+		{"ipv4", "version 1.2.3.256", "version 1.2.3.256", 0},
+	}
+	for _, tt := range tests {
+		p, err := newRedact(Config{Field: "message", Detectors: []string{tt.detector}, Mask: "***"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		event := &Event{Fields: map[string]interface{}{"message": tt.in}}
+		if _, err := p.Process(event); err != nil {
+			t.Fatalf("%s %q: %s", tt.detector, tt.in, err)
+		}
+		if got := event.Fields["message"]; got != tt.want {
+			t.Errorf("%s %q = %q, want %q", tt.detector, tt.in, got, tt.want)
+		}
+		if got := p.Counts()[tt.detector]; got != tt.matches {
+			t.Errorf("%s %q matches = %d, want %d", tt.detector, tt.in, got, tt.matches)
+		}
+	}
+}
+
+func TestRedactHash(t *testing.T) {
+	p, err := newRedact(Config{Fields: []string{"user"}, Detectors: []string{"email"}, Mode: RedactHash, HashKey: "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := func(s string) string {
+		event := &Event{Fields: map[string]interface{}{"user": map[string]interface{}{"emails": []interface{}{s}}}}
+		if _, err := p.Process(event); err != nil {
+			t.Fatal(err)
+		}
+		return event.Fields["user"].(map[string]interface{})["emails"].([]interface{})[0].(string)
+	}
+	a, b := hash("a@example.com"), hash("b@example.com")
+	if a == "a@example.com" || len(a) != 32 {
+		t.Errorf("hash = %q, want 32 hex digits", a)
+	}
+	if a == b || a != hash("a@example.com") {
+		t.Errorf("hashes of a and b = %q, %q", a, b)
+	}
+}
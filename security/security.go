@@ -0,0 +1,127 @@
+package security
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	"os"
+	"strings"
+)
+
+// sasl mechanisms
+const (
+	MechanismPlain       = "PLAIN"
+	MechanismScramSHA256 = "SCRAM-SHA-256"
+	MechanismScramSHA512 = "SCRAM-SHA-512"
+)
+
+type TLSConfig struct {
+	Enabled            bool
+	CAFile             string // pem certificates of the server CAs Default: system pool
+	CertFile           string // pem client certificate
+	KeyFile            string // pem client key
+	InsecureSkipVerify bool
+	ServerName         string // Default: host of the address
+	Fingerprint        string // sha256 hex fingerprint of a certificate of the server chain, replaces the CA verification
+}
+
+// New returns the tls config, nil when tls is not enabled.
+func (cfg TLSConfig) New() (*tls.Config, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		ServerName:         cfg.ServerName,
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", cfg.CAFile)
+		}
+	}
+	if cfg.Fingerprint != "" {
+		fingerprint, err := hex.DecodeString(strings.ReplaceAll(cfg.Fingerprint, ":", ""))
+		if err != nil || len(fingerprint) != sha256.Size {
+			return nil, fmt.Errorf("invalid sha256 fingerprint %q", cfg.Fingerprint)
+		}
+		// the chain is trusted when it contains the pinned certificate, such as the
+		// self-signed CA elasticsearch generates on first launch
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				if sum := sha256.Sum256(cert.Raw); bytes.Equal(sum[:], fingerprint) {
+					return nil
+				}
+			}
+			return fmt.Errorf("no certificate of %s matches the fingerprint", state.ServerName)
+		}
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+type SASLConfig struct {
+	Mechanism    string // PLAIN, SCRAM-SHA-256, SCRAM-SHA-512, "" disables sasl
+	Username     string
+	UsernameFile string // read when Username is empty
+	Password     string
+	PasswordFile string // read when Password is empty
+}
+
+// New returns the sasl mechanism, nil when sasl is not enabled.
+func (cfg SASLConfig) New() (sasl.Mechanism, error) {
+	if cfg.Mechanism == "" {
+		return nil, nil
+	}
+	username, err := Secret(cfg.Username, cfg.UsernameFile)
+	if err != nil {
+		return nil, fmt.Errorf("sasl username: %w", err)
+	}
+	password, err := Secret(cfg.Password, cfg.PasswordFile)
+	if err != nil {
+		return nil, fmt.Errorf("sasl password: %w", err)
+	}
+	if username == "" {
+		return nil, fmt.Errorf("sasl username is required")
+	}
+	switch strings.ToUpper(cfg.Mechanism) {
+	case MechanismPlain:
+		return plain.Mechanism{Username: username, Password: password}, nil
+	case MechanismScramSHA256:
+		return scram.Mechanism(scram.SHA256, username, password)
+	case MechanismScramSHA512:
+		return scram.Mechanism(scram.SHA512, username, password)
+	}
+	return nil, fmt.Errorf("unknown sasl mechanism %q", cfg.Mechanism)
+}
+
+// Secret returns value, or the content of file without its trailing new line when value is empty,
+// so that secrets can be mounted as files instead of written in the config.
+func Secret(value, file string) (string, error) {
+	if value != "" || file == "" {
+		return value, nil
+	}
+	body, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(body), "\r\n"), nil
+}
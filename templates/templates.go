@@ -0,0 +1,190 @@
+package templates
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"gopkg.in/yaml.v3"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// checksumKey is the _meta field holding the checksum of the installed template content
+const checksumKey = "k2es_checksum"
+
+// template kinds, also the sub directories of the templates directory
+const (
+	Component = "component"
+	Index     = "index"
+)
+
+type Config struct {
+	Client *elasticsearch.Client
+	// Dir contains the component templates in Dir/component and the
+	// composable index templates in Dir/index, as json or yaml files named after the template.
+	Dir string
+}
+
+// Install installs or upgrades the component templates and then the index templates of the
+// directory. A template is only updated when its content changed since the last installation.
+func Install(ctx context.Context, cfg Config) error {
+	if cfg.Client == nil {
+		return fmt.Errorf("elasticsearch client is required")
+	}
+	for _, kind := range []string{Component, Index} {
+		files, err := list(filepath.Join(cfg.Dir, kind))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err = install(ctx, cfg.Client, kind, file); err != nil {
+				return fmt.Errorf("%s template %s: %w", kind, file, err)
+			}
+		}
+	}
+	return nil
+}
+
+func list(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".json", ".yaml", ".yml":
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func install(ctx context.Context, es *elasticsearch.Client, kind, file string) error {
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	body, checksum, err := load(file)
+	if err != nil {
+		return err
+	}
+	installed, err := installedChecksum(ctx, es, kind, name)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	if installed == checksum {
+		return nil
+	}
+
+	var res *esapi.Response
+	switch kind {
+	case Component:
+		res, err = esapi.ClusterPutComponentTemplateRequest{Name: name, Body: bytes.NewReader(body)}.Do(ctx, es)
+	default:
+		res, err = esapi.IndicesPutIndexTemplateRequest{Name: name, Body: bytes.NewReader(body)}.Do(ctx, es)
+	}
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("put: %s", res.String())
+	}
+	log.Printf("installed %s template %s checksum %s", kind, name, checksum)
+	return nil
+}
+
+// load reads a json or yaml template, it returns the json body with the checksum in _meta.
+func load(file string) ([]byte, string, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, "", err
+	}
+	template := make(map[string]interface{})
+	if filepath.Ext(file) == ".json" {
+		err = json.Unmarshal(content, &template)
+	} else {
+		err = yaml.Unmarshal(content, &template)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("decode: %w", err)
+	}
+	// json object keys are sorted, the encoding does not depend on the file format
+	canonical, err := json.Marshal(template)
+	if err != nil {
+		return nil, "", fmt.Errorf("encode: %w", err)
+	}
+	sum := sha256.Sum256(canonical)
+	checksum := hex.EncodeToString(sum[:])
+
+	meta, _ := template["_meta"].(map[string]interface{})
+	if meta == nil {
+		meta = make(map[string]interface{})
+	}
+	meta[checksumKey] = checksum
+	template["_meta"] = meta
+	body, err := json.Marshal(template)
+	if err != nil {
+		return nil, "", fmt.Errorf("encode: %w", err)
+	}
+	return body, checksum, nil
+}
+
+// installedChecksum returns the checksum of the installed template, "" when not installed.
+func installedChecksum(ctx context.Context, es *elasticsearch.Client, kind, name string) (string, error) {
+	var res *esapi.Response
+	var err error
+	switch kind {
+	case Component:
+		res, err = esapi.ClusterGetComponentTemplateRequest{Name: []string{name}}.Do(ctx, es)
+	default:
+		res, err = esapi.IndicesGetIndexTemplateRequest{Name: name}.Do(ctx, es)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if res.IsError() {
+		return "", fmt.Errorf("%s", res.String())
+	}
+
+	type meta struct {
+		Meta map[string]interface{} `json:"_meta"`
+	}
+	var body struct {
+		ComponentTemplates []struct {
+			ComponentTemplate meta `json:"component_template"`
+		} `json:"component_templates"`
+		IndexTemplates []struct {
+			IndexTemplate meta `json:"index_template"`
+		} `json:"index_templates"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decode: %w", err)
+	}
+	var installed map[string]interface{}
+	if len(body.ComponentTemplates) > 0 {
+		installed = body.ComponentTemplates[0].ComponentTemplate.Meta
+	} else if len(body.IndexTemplates) > 0 {
+		installed = body.IndexTemplates[0].IndexTemplate.Meta
+	}
+	checksum, _ := installed[checksumKey].(string)
+	return checksum, nil
+}